@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tokenUsage accumulates the usageMetadata of every API call made during a run
+type tokenUsage struct {
+	mu                   sync.Mutex
+	Calls                int `json:"calls"`
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+	// Distinct modelVersion values reported by the API, in the order they were first seen
+	ModelVersions    []string `json:"modelVersions,omitempty"`
+	lastModelVersion string
+}
+
+func (u *tokenUsage) add(promptTokens, candidatesTokens, totalTokens int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Calls++
+	u.PromptTokenCount += promptTokens
+	u.CandidatesTokenCount += candidatesTokens
+	u.TotalTokenCount += totalTokens
+}
+
+// addModelVersion records the concrete model version that served a response
+func (u *tokenUsage) addModelVersion(version string) {
+	if version == "" {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastModelVersion = version
+	if !slices.Contains(u.ModelVersions, version) {
+		u.ModelVersions = append(u.ModelVersions, version)
+	}
+}
+
+// lastVersion returns the model version of the most recent response, or "" when none was reported
+func (u *tokenUsage) lastVersion() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lastModelVersion
+}
+
+// attachmentDigest identifies an attachment in the audit log without including its content
+type attachmentDigest struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// auditRecord is one line of the --audit-log file. It holds only metadata and hashes, never the
+// instruction, prompt, attachment, or response content.
+type auditRecord struct {
+	Timestamp         string             `json:"timestamp"`
+	RequestID         string             `json:"requestId"`
+	Project           string             `json:"project"`
+	Location          string             `json:"location"`
+	Model             string             `json:"model"`
+	SystemInstruction string             `json:"systemInstructionSha256"`
+	Prompts           []string           `json:"promptSha256"`
+	Schemas           []string           `json:"schemaSha256"`
+	Attachments       []attachmentDigest `json:"attachments"`
+	Usage             *tokenUsage        `json:"usage"`
+	Status            string             `json:"status"`
+	ExitCode          int                `json:"exitCode"`
+	Error             string             `json:"error,omitempty"` // Only for failures before any request, whose messages quote no content
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAuditRecord appends the audit record of this invocation, with the outcome given by err,
+// to the --audit-log file as a single JSON line
+func appendAuditRecord(config *Config, err error) error {
+	return writeAuditRecord(config, err, "")
+}
+
+// appendConfigAuditRecord appends the audit record of an invocation that failed while loading or
+// checking the configuration, before any request was made. Such errors quote no content, so the
+// record includes the message. Without a loaded configuration (nil) only the outcome and a
+// --request-id are known.
+func appendConfigAuditRecord(config *Config, err error) error {
+	return writeAuditRecord(config, err, err.Error())
+}
+
+func writeAuditRecord(config *Config, err error, message string) error {
+	record := auditRecord{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		RequestID:   requestID,
+		Prompts:     []string{},
+		Schemas:     []string{},
+		Attachments: []attachmentDigest{},
+		Status:      "success",
+		Error:       message,
+	}
+	if config != nil {
+		record.RequestID = config.RequestID
+		record.Project = config.Project
+		record.Location = config.Location
+		record.Model = config.Model
+		record.SystemInstruction = config.SystemInstructionSHA256
+		record.Attachments = append(record.Attachments, config.AttachmentDigests...)
+		record.Usage = config.Usage
+		if len(config.Prompts) > 0 {
+			for _, prompt := range config.Prompts {
+				record.Prompts = append(record.Prompts, sha256Hex([]byte(prompt)))
+			}
+		} else {
+			record.Prompts = append(record.Prompts, sha256Hex([]byte(config.Prompt)))
+		}
+		for _, schema := range config.CompiledSchemas {
+			record.Schemas = append(record.Schemas, schema.SHA256)
+		}
+	}
+	if err != nil {
+		record.Status = "failure"
+		record.ExitCode = getExitCode(err)
+	}
+
+	// The usage is shared with the run
+	if config != nil {
+		config.Usage.mu.Lock()
+	}
+	line, marshalErr := json.Marshal(record)
+	if config != nil {
+		config.Usage.mu.Unlock()
+	}
+	if marshalErr != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", marshalErr)
+	}
+
+	file, openErr := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return fmt.Errorf("failed to open audit log: %v", openErr)
+	}
+	defer file.Close()
+	if _, writeErr := file.Write(append(line, '\n')); writeErr != nil {
+		return fmt.Errorf("failed to write audit log: %v", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Jitter strategies of --retry-jitter
+const (
+	retryJitterNone  = "none"
+	retryJitterFull  = "full"
+	retryJitterEqual = "equal"
+)
+
+// retryBackoff computes the delays between retries of transient API failures. The random source,
+// seeded by --retry-seed when set, is shared by every request of the run.
+type retryBackoff struct {
+	mu     sync.Mutex
+	jitter string
+	rand   *rand.Rand
+}
+
+func newRetryBackoff(jitter string, seed uint64, seeded bool) *retryBackoff {
+	if !seeded {
+		seed = rand.Uint64()
+	}
+	return &retryBackoff{jitter: jitter, rand: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// backoffCap returns the delay before retry attempt+1 without jitter: the base delay doubled once
+// per earlier attempt, capped at the max delay
+func backoffCap(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 0; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// delay returns the delay before retry attempt+1. With full jitter it is uniformly random between
+// zero and the cap, with equal jitter between half the cap and the cap, and otherwise the cap.
+func (b *retryBackoff) delay(attempt int) time.Duration {
+	limit := backoffCap(attempt)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.jitter {
+	case retryJitterFull:
+		return time.Duration(b.rand.Int64N(int64(limit) + 1))
+	case retryJitterEqual:
+		return limit/2 + time.Duration(b.rand.Int64N(int64(limit/2)+1))
+	default:
+		return limit
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Modes of --wrap-base64
+const (
+	base64DisplayWrap     = "wrap"
+	base64DisplayTruncate = "truncate"
+)
+
+const (
+	base64WrapWidth  = 76 // Line length of MIME base64
+	base64KeptPrefix = 64 // Characters of the data kept when truncating
+)
+
+// A "data" member holding a base64 string longer than one wrapped line, as in inlineData
+var base64DataPattern = regexp.MustCompile(`"data":( ?)"([A-Za-z0-9+/]{76,}={0,2})"`)
+
+// displayBase64 rewrites the base64 data of a request body shown by --show-request-body so that a
+// person can read the rest of it. With wrap, each value is broken into lines of 76 characters,
+// aligned under its opening quote, which is no longer valid JSON. With truncate, each value is cut
+// to its first 64 characters followed by a note of its length, which is valid JSON but not the
+// data. Only the displayed copy is rewritten; the request that would be sent is not.
+func displayBase64(body, mode string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range base64DataPattern.FindAllStringSubmatchIndex(body, -1) {
+		separator, data := body[m[2]:m[3]], body[m[4]:m[5]]
+		b.WriteString(body[last:m[0]])
+		last = m[1]
+
+		if mode == base64DisplayTruncate {
+			decoded := len(data)/4*3 - strings.Count(data, "=")
+			fmt.Fprintf(&b, `"data":%s"%s... (%d base64 characters, %d bytes)"`, separator, data[:base64KeptPrefix], len(data), decoded)
+			continue
+		}
+
+		// Continuation lines start in the column after the opening quote
+		column := m[4] - strings.LastIndex(body[:m[4]], "\n") - 1
+		fmt.Fprintf(&b, `"data":%s"`, separator)
+		for len(data) > base64WrapWidth {
+			b.WriteString(data[:base64WrapWidth] + "\n" + strings.Repeat(" ", column))
+			data = data[base64WrapWidth:]
+		}
+		b.WriteString(data + `"`)
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// baselineDiff lists where a result differs from the --baseline-file, by JSON Pointer
+type baselineDiff struct {
+	Added   []baselineValue  `json:"added"`
+	Removed []baselineValue  `json:"removed"`
+	Changed []baselineChange `json:"changed"`
+}
+
+type baselineValue struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+type baselineChange struct {
+	Path     string      `json:"path"`
+	Baseline interface{} `json:"baseline"`
+	Current  interface{} `json:"current"`
+}
+
+func (d *baselineDiff) size() int {
+	return len(d.Added) + len(d.Removed) + len(d.Changed)
+}
+
+// loadBaseline reads the --baseline-file, a result written by an earlier run
+func loadBaseline(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read baseline file: %v", err)}
+	}
+	baseline, err := decodeBaselineJSON(content)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid JSON in baseline file %s: %v", path, err)}
+	}
+	return baseline, nil
+}
+
+// decodeBaselineJSON decodes a single JSON value, keeping numbers as written
+func decodeBaselineJSON(content []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(bytes.TrimPrefix(content, []byte("\xEF\xBB\xBF"))))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+// compareWithBaseline reports how the written result differs from the --baseline-file: as a JSON
+// line on STDERR, or in the --diff-file, which is replaced even when nothing differs so that it
+// never describes an earlier run. With --fail-on-diff any difference is a driftError.
+func compareWithBaseline(config *Config, output string) error {
+	current, err := decodeBaselineJSON([]byte(output))
+	if err != nil {
+		return &validationError{fmt.Sprintf("failed to parse the result for --baseline-file: %v", err)}
+	}
+	diff := &baselineDiff{Added: []baselineValue{}, Removed: []baselineValue{}, Changed: []baselineChange{}}
+	diffJSON(diff, "", config.Baseline, current)
+
+	encoded, err := json.Marshal(diff)
+	if err != nil {
+		return &inputError{fmt.Sprintf("failed to encode baseline diff: %v", err)}
+	}
+	if config.DiffFile != "" {
+		var prettyBuf bytes.Buffer
+		json.Indent(&prettyBuf, encoded, "", "  ")
+		prettyBuf.WriteString("\n")
+		if err := os.WriteFile(config.DiffFile, prettyBuf.Bytes(), 0644); err != nil {
+			return &inputError{fmt.Sprintf("failed to write diff file: %v", err)}
+		}
+	}
+
+	switch {
+	case diff.size() == 0:
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Baseline: result matches %s\n", config.BaselineFile)
+		}
+		return nil
+	case config.DiffFile != "":
+		config.Log.Printf("Baseline: result differs from %s (%d added, %d removed, %d changed); diff written to %s\n",
+			config.BaselineFile, len(diff.Added), len(diff.Removed), len(diff.Changed), config.DiffFile)
+	default:
+		config.Log.Printf("Baseline diff: %s\n", encoded)
+	}
+	if config.FailOnDiff {
+		return &driftError{fmt.Sprintf("result differs from --baseline-file %s at %d paths", config.BaselineFile, diff.size())}
+	}
+	return nil
+}
+
+// diffJSON adds the differences between two decoded JSON values to diff. Objects are compared
+// member by member and arrays element by element, so an element inserted into an array shows as
+// every later element changed and the last one added; values of different types are changed
+// as a whole.
+func diffJSON(diff *baselineDiff, path string, baseline, current interface{}) {
+	switch b := baseline.(type) {
+	case map[string]interface{}:
+		if c, ok := current.(map[string]interface{}); ok {
+			for _, key := range slices.Sorted(maps.Keys(b)) {
+				memberPath := path + "/" + escapeJSONPointerToken(key)
+				if value, ok := c[key]; ok {
+					diffJSON(diff, memberPath, b[key], value)
+				} else {
+					diff.Removed = append(diff.Removed, baselineValue{memberPath, b[key]})
+				}
+			}
+			for _, key := range slices.Sorted(maps.Keys(c)) {
+				if _, ok := b[key]; !ok {
+					diff.Added = append(diff.Added, baselineValue{path + "/" + escapeJSONPointerToken(key), c[key]})
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if c, ok := current.([]interface{}); ok {
+			for i := 0; i < max(len(b), len(c)); i++ {
+				elementPath := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(c):
+					diff.Removed = append(diff.Removed, baselineValue{elementPath, b[i]})
+				case i >= len(b):
+					diff.Added = append(diff.Added, baselineValue{elementPath, c[i]})
+				default:
+					diffJSON(diff, elementPath, b[i], c[i])
+				}
+			}
+			return
+		}
+	default:
+		if equalJSONScalars(baseline, current) {
+			return
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+	diff.Changed = append(diff.Changed, baselineChange{path, baseline, current})
+}
+
+// equalJSONScalars compares two scalars, treating numbers written differently but with the same
+// value, such as 5 and 5.0, as equal
+func equalJSONScalars(a, b interface{}) bool {
+	aNumber, aIsNumber := a.(json.Number)
+	bNumber, bIsNumber := b.(json.Number)
+	if aIsNumber && bIsNumber {
+		if aNumber == bNumber {
+			return true
+		}
+		aValue, aErr := strconv.ParseFloat(aNumber.String(), 64)
+		bValue, bErr := strconv.ParseFloat(bNumber.String(), 64)
+		return aErr == nil && bErr == nil && aValue == bValue
+	}
+	if aIsNumber || bIsNumber {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmarkCall is the outcome of one request sent by --benchmark
+type benchmarkCall struct {
+	Latency time.Duration
+	Output  string // Validated and formatted result; empty on failure
+	Err     error
+}
+
+// runBenchmark sends the same request config.Benchmark times, with up to config.Concurrency in
+// flight, through one shared HTTP client and token source, and logs the latency percentiles of the
+// successful calls, the success rate, and the throughput to STDERR. Each call is validated like a
+// normal run. Results are only written with --benchmark-results; the first failure determines the
+// exit status.
+func runBenchmark(config *Config, attachmentParts []interface{}) error {
+	requestBody, err := buildGeminiRequest(config, attachmentParts)
+	if err != nil {
+		return recordFailure(config, stageRequest, err)
+	}
+	if config.NoCachePrompt {
+		// Each call is built with its own nonce instead
+		requestBody = nil
+	}
+	session, err := newAPISession(config)
+	if err != nil {
+		return recordFailure(config, stageAPI, err)
+	}
+	config.Session = session
+
+	calls := make([]benchmarkCall, config.Benchmark)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(config.Concurrency, config.Benchmark) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				calls[i] = benchmarkRequest(config, attachmentParts, requestBody, i)
+			}
+		}()
+	}
+	for i := range calls {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var latencies []time.Duration
+	var results []string
+	var firstErr error
+	failures := map[string]int{}
+	for _, call := range calls {
+		if call.Err != nil {
+			failures[exitStatusName(call.Err)]++
+			if firstErr == nil {
+				firstErr = call.Err
+			}
+			continue
+		}
+		latencies = append(latencies, call.Latency)
+		results = append(results, call.Output)
+	}
+	logBenchmarkSummary(config, latencies, failures, elapsed)
+
+	if config.BenchmarkResults && len(results) > 0 {
+		if err := writeResult(config, strings.Join(results, "\n")); err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+	}
+	return firstErr
+}
+
+// benchmarkRequest sends one benchmark request and validates the response. Each call has its own
+// request ID so that failures can be traced in the server logs. A nil requestBody is built for the
+// call, so that --no-cache-prompt gives it its own nonce.
+func benchmarkRequest(config *Config, attachmentParts []interface{}, requestBody []byte, i int) benchmarkCall {
+	callConfig := *config
+	callConfig.RequestID = fmt.Sprintf("%s-%d", config.RequestID, i+1)
+	callConfig.Log = config.Log.withPrefix(callConfig.RequestID)
+
+	if requestBody == nil {
+		var err error
+		if requestBody, err = buildGeminiRequest(&callConfig, attachmentParts); err != nil {
+			recordFailure(&callConfig, stageRequest, err)
+			return benchmarkCall{Err: err}
+		}
+	}
+
+	start := time.Now()
+	responseJSON, err := callGeminiWithFailover(&callConfig, requestBody)
+	latency := time.Since(start)
+	stage := stageAPI
+	var output string
+	if err == nil {
+		stage = stageValidation
+		output, err = validateAndFormatJSON(&callConfig, responseJSON)
+	}
+	if err != nil {
+		recordFailure(&callConfig, stage, err)
+		if callConfig.Verbosity >= verbosityRequest {
+			callConfig.Log.Printf("Benchmark: request %d failed after %s: %v\n", i+1, latency.Round(time.Millisecond), err)
+		}
+		return benchmarkCall{Latency: latency, Err: err}
+	}
+	return benchmarkCall{Latency: latency, Output: output}
+}
+
+func logBenchmarkSummary(config *Config, latencies []time.Duration, failures map[string]int, elapsed time.Duration) {
+	total := len(latencies)
+	for _, count := range failures {
+		total += count
+	}
+	summary := fmt.Sprintf("Benchmark: %d requests, concurrency %d, %d succeeded (%.1f%%)",
+		total, min(config.Concurrency, total), len(latencies), 100*float64(len(latencies))/float64(total))
+	if len(failures) > 0 {
+		var counts []string
+		for _, name := range slices.Sorted(maps.Keys(failures)) {
+			counts = append(counts, fmt.Sprintf("%d %s", failures[name], name))
+		}
+		summary += "; failed: " + strings.Join(counts, ", ")
+	}
+	config.Log.Printf("%s\n", summary)
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		config.Log.Printf("Benchmark latency: min %s, p50 %s, p95 %s, p99 %s, max %s\n",
+			latencies[0].Round(time.Millisecond),
+			latencyPercentile(latencies, 50).Round(time.Millisecond),
+			latencyPercentile(latencies, 95).Round(time.Millisecond),
+			latencyPercentile(latencies, 99).Round(time.Millisecond),
+			latencies[len(latencies)-1].Round(time.Millisecond))
+	}
+	config.Log.Printf("Benchmark throughput: %.2f requests/s over %s\n", float64(total)/elapsed.Seconds(), elapsed.Round(time.Millisecond))
+}
+
+// latencyPercentile returns the nearest-rank percentile of sorted latencies
+func latencyPercentile(sorted []time.Duration, percentile float64) time.Duration {
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// Strategies for merging the validated results of the chunks of a PDF
+const (
+	mergeStrategyConcat = "concat"
+	mergeStrategyMerge  = "merge"
+)
+
+func init() {
+	// Use pdfcpu's built-in defaults rather than creating a configuration directory for the user
+	model.ConfigPath = "disable"
+}
+
+// splitPDF splits a PDF into documents of at most pagesPerChunk pages each, in page order, and
+// returns them along with the total page count
+func splitPDF(content []byte, pagesPerChunk int) ([][]byte, int, error) {
+	conf := model.NewDefaultConfiguration()
+	pageCount, err := api.PageCount(bytes.NewReader(content), conf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var chunks [][]byte
+	for first := 1; first <= pageCount; first += pagesPerChunk {
+		last := first + pagesPerChunk - 1
+		if last > pageCount {
+			last = pageCount
+		}
+		var chunk bytes.Buffer
+		if err := api.Trim(bytes.NewReader(content), &chunk, []string{fmt.Sprintf("%d-%d", first, last)}, conf); err != nil {
+			return nil, 0, fmt.Errorf("pages %d-%d: %v", first, last, err)
+		}
+		chunks = append(chunks, chunk.Bytes())
+	}
+	return chunks, pageCount, nil
+}
+
+// mergeChunkResults combines the decoded results of each chunk in order. The concat strategy
+// requires every result to be an array and concatenates them; the merge strategy requires every
+// result to be an object and deep-merges them with mergeJSONValues.
+func mergeChunkResults(results []interface{}, strategy string) (interface{}, error) {
+	if strategy == mergeStrategyConcat {
+		merged := []interface{}{}
+		for i, result := range results {
+			items, ok := result.([]interface{})
+			if !ok {
+				return nil, &validationError{fmt.Sprintf("result of chunk %d is not a JSON array, which --merge-strategy concat requires", i+1)}
+			}
+			merged = append(merged, items...)
+		}
+		return merged, nil
+	}
+
+	var merged interface{} = map[string]interface{}{}
+	for i, result := range results {
+		if _, ok := result.(map[string]interface{}); !ok {
+			return nil, &validationError{fmt.Sprintf("result of chunk %d is not a JSON object, which --merge-strategy merge requires", i+1)}
+		}
+		merged = mergeJSONValues(merged, result)
+	}
+	return merged, nil
+}
+
+// mergeJSONValues merges b into a: objects are merged member by member, arrays are concatenated,
+// null leaves a unchanged, and any other value in b replaces a
+func mergeJSONValues(a, b interface{}) interface{} {
+	switch bv := b.(type) {
+	case nil:
+		return a
+	case map[string]interface{}:
+		av, ok := a.(map[string]interface{})
+		if !ok {
+			return bv
+		}
+		for key, value := range bv {
+			if existing, ok := av[key]; ok {
+				av[key] = mergeJSONValues(existing, value)
+			} else {
+				av[key] = value
+			}
+		}
+		return av
+	case []interface{}:
+		if av, ok := a.([]interface{}); ok {
+			return append(av, bv...)
+		}
+		return bv
+	default:
+		return b
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// command is a subcommand, named by the first non-flag argument
+type command struct {
+	name    string
+	flags   [][]string // Groups of flags accepted besides commonFlags; nil accepts every flag
+	schema  bool       // Loads and compiles the schemas
+	request bool       // Also loads the system instruction, prompt, attachments, and API settings
+	help    string     // Text printed by --help; generate prints the full option list instead
+}
+
+// Flags accepted by every command
+var commonFlags = []string{
+	"help", "version", "verbose", "verbosity", "v", "quiet", "fail-on-warnings",
+	"log-file", "syslog", "syslog-priority", "syslog-tag", "status-line", "errors-file", "audit-log",
+}
+
+// Flags of the groups that commands share
+var (
+	outputFlags = []string{"out", "pretty-print", "normalize", "sorted", "no-sort-keys", "bom", "crlf", "trailing-newline", "pretty-stdout", "syslog-results"}
+	schemaFlags = []string{
+		"schema", "schema-file", "schema-env", "schema-select", "schema-cache", "lenient-schema-json", "strict-schema",
+		"allow-remote-refs", "validate-only-against-draft", "gen-schema-file", "emit-property-ordering", "warn-schema-bytes",
+		"timeout", "connect-timeout", "prefer-ipv4", // Remote $ref fetches use the connection settings
+	}
+	validationFlags = []string{
+		"validate-pointer", "min-confidence", "confidence-pointer", "strict-json-number", "coerce-integers",
+		"apply-defaults", "fail-on-empty-object", "extract-first-json", "use-embedded-schema", "validation-exit-code", "max-errors",
+	}
+	requestFlags = []string{
+		"system-instruction", "system-instruction-file", "system-instruction-env", "system-instruction-template", "set",
+		"prompt", "prompt-file", "prompt-file-separator", "prompt-env", "prompt-template", "prompt-delimiter", "parts-file", "request-template",
+		"attach", "attach-type", "max-attachments", "attachments-first", "require-attachments", "dedup-attachments", "pdf-chunk-pages",
+		"project", "quota-project", "location", "model", "model-locations", "deprecated-models", "allowed-models",
+		"temperature", "top-k", "seed", "deterministic", "grounding", "no-cache-prompt", "request-id",
+		"timeout", "connect-timeout", "auth-timeout", "prefer-ipv4", "max-response-bytes", "strict-content-type",
+		"credentials-source", "credentials-file", "scope",
+	}
+)
+
+var (
+	generateCommand = &command{name: "generate", schema: true, request: true}
+
+	validateCommand = &command{
+		name:   "validate",
+		flags:  [][]string{schemaFlags, validationFlags, outputFlags},
+		schema: true,
+		help: `prompt2json validate - Validate JSON from stdin against a schema, without calling the API
+
+Usage:
+  prompt2json validate --schema JSON | --schema-file PATH | --schema-env NAME [OPTIONS] < response.json
+
+The JSON is checked exactly as a generated response would be, and written formatted like a result
+when it passes. The exit status is 4 (or --validation-exit-code) when it fails.
+
+Schema:
+  --schema JSON, --schema-file PATH (repeatable), --schema-env NAME, --schema-select NAME,
+  --schema-cache N, --lenient-schema-json, --strict-schema, --allow-remote-refs,
+  --validate-only-against-draft DRAFT, --gen-schema-file PATH, --emit-property-ordering,
+  --warn-schema-bytes N, --timeout SECONDS, --connect-timeout SECONDS, --prefer-ipv4
+
+Validation:
+  --validate-pointer PTR, --min-confidence N, --confidence-pointer PTR, --strict-json-number,
+  --coerce-integers, --apply-defaults, --fail-on-empty-object, --extract-first-json,
+  --use-embedded-schema MODE, --validation-exit-code N, --max-errors N
+
+Output:
+  --out PATH, --pretty-print, --normalize, --sorted, --no-sort-keys, --bom, --crlf,
+  --trailing-newline=false, --pretty-stdout, --syslog-results
+
+Misc:
+  --verbose, --verbosity N, -v, --quiet, --fail-on-warnings, --log-file PATH, --syslog,
+  --syslog-priority PRIORITY, --syslog-tag TAG, --status-line, --errors-file PATH,
+  --audit-log PATH, --help
+
+See 'prompt2json --help' for the description of each option.
+`,
+	}
+
+	countTokensCommand = &command{
+		name:    "count-tokens",
+		flags:   [][]string{schemaFlags, requestFlags, outputFlags},
+		schema:  true,
+		request: true,
+		help: `prompt2json count-tokens - Count the prompt tokens of the requests without generating a response
+
+Usage:
+  prompt2json count-tokens [OPTIONS]
+
+Builds the same requests as generate and counts their prompt tokens with the countTokens API,
+writing {"model": ..., "requests": N, "promptTokens": N}. The system instruction, schema, project,
+location, and model are required as for generate.
+
+Request:
+  --system-instruction TEXT, --system-instruction-file PATH, --system-instruction-env NAME,
+  --system-instruction-template PATH, --set NAME=VALUE, --prompt TEXT, --prompt-file PATH,
+  --prompt-file-separator STR, --prompt-env NAME, --prompt-template TEXT, --prompt-delimiter STR,
+  --parts-file PATH, --request-template PATH, --attach PATH, --attach-type TYPE,
+  --max-attachments N, --attachments-first, --require-attachments, --dedup-attachments,
+  --pdf-chunk-pages N, --temperature N, --top-k N, --seed N, --deterministic, --grounding,
+  --no-cache-prompt
+
+Schema:
+  --schema JSON, --schema-file PATH (repeatable), --schema-env NAME, --schema-select NAME,
+  --schema-cache N, --lenient-schema-json, --strict-schema, --allow-remote-refs,
+  --validate-only-against-draft DRAFT, --gen-schema-file PATH, --emit-property-ordering,
+  --warn-schema-bytes N
+
+API and credentials:
+  --project ID, --quota-project ID, --location REGION, --model NAME, --model-locations PATH,
+  --deprecated-models PATH, --allowed-models LIST, --request-id ID, --timeout SECONDS,
+  --connect-timeout SECONDS, --auth-timeout SECONDS, --prefer-ipv4, --max-response-bytes N,
+  --strict-content-type, --credentials-source SOURCE, --credentials-file PATH, --scope SCOPE
+
+Output:
+  --out PATH, --pretty-print, --normalize, --sorted, --no-sort-keys, --bom, --crlf,
+  --trailing-newline=false, --pretty-stdout, --syslog-results
+
+Misc:
+  --verbose, --verbosity N, -v, --quiet, --fail-on-warnings, --log-file PATH, --syslog,
+  --syslog-priority PRIORITY, --syslog-tag TAG, --status-line, --errors-file PATH,
+  --audit-log PATH, --help
+
+See 'prompt2json --help' for the description of each option.
+`,
+	}
+
+	listModelsCommand = &command{
+		name:  "list-models",
+		flags: [][]string{{"model-locations", "deprecated-models", "price-file"}, outputFlags},
+		help: `prompt2json list-models - List the models this version has built-in settings for
+
+Usage:
+  prompt2json list-models [OPTIONS]
+
+Writes a JSON array with an entry per model that has a default location, a price, or a
+deprecation, sorted by model: {"model": ..., "defaultLocation": ..., "pricePer1kTokens": ...,
+"replacement": ...}. Absent members do not apply to the model. Any other model can still be used.
+
+Options:
+  --model-locations PATH     Extend or override the default locations
+  --deprecated-models PATH   Extend or override the deprecated models and their replacements
+  --price-file PATH          Extend or override the prices per 1,000 prompt tokens
+
+Output:
+  --out PATH, --pretty-print, --normalize, --sorted, --no-sort-keys, --bom, --crlf,
+  --trailing-newline=false, --pretty-stdout, --syslog-results
+
+Misc:
+  --verbose, --verbosity N, -v, --quiet, --fail-on-warnings, --log-file PATH, --syslog,
+  --syslog-priority PRIORITY, --syslog-tag TAG, --status-line, --errors-file PATH,
+  --audit-log PATH, --help
+
+See 'prompt2json --help' for the description of each option.
+`,
+	}
+
+	lintSchemaCommand = &command{
+		name:   "lint-schema",
+		flags:  [][]string{schemaFlags, outputFlags},
+		schema: true,
+		help: `prompt2json lint-schema - Check that the schemas compile, without calling the API
+
+Usage:
+  prompt2json lint-schema --schema JSON | --schema-file PATH | --schema-env NAME [OPTIONS]
+
+Compiles every schema with the same checks as generate, including --strict-schema and
+--warn-schema-bytes, and writes a summary: {"schemas": [{"source": ..., "draft": ...,
+"sha256": ...}], "sentSchemaBytes": N, "warnings": N}. The exit status is 3 when a schema is
+invalid, or 10 with --fail-on-warnings when a warning fires.
+
+Schema:
+  --schema JSON, --schema-file PATH (repeatable), --schema-env NAME, --schema-select NAME,
+  --schema-cache N, --lenient-schema-json, --strict-schema, --allow-remote-refs,
+  --validate-only-against-draft DRAFT, --gen-schema-file PATH, --emit-property-ordering,
+  --warn-schema-bytes N, --timeout SECONDS, --connect-timeout SECONDS, --prefer-ipv4
+
+Output:
+  --out PATH, --pretty-print, --normalize, --sorted, --no-sort-keys, --bom, --crlf,
+  --trailing-newline=false, --pretty-stdout, --syslog-results
+
+Misc:
+  --verbose, --verbosity N, -v, --quiet, --fail-on-warnings, --log-file PATH, --syslog,
+  --syslog-priority PRIORITY, --syslog-tag TAG, --status-line, --errors-file PATH,
+  --audit-log PATH, --help
+
+See 'prompt2json --help' for the description of each option.
+`,
+	}
+
+	commands = []*command{generateCommand, validateCommand, countTokensCommand, listModelsCommand, lintSchemaCommand}
+
+	// The command of this run; a run without one generates, as before commands existed
+	activeCommand = generateCommand
+)
+
+// selectCommand selects the command named by the first non-flag argument and parses the flags that
+// follow it. Flags may be given before the command as well.
+func selectCommand() error {
+	if flag.NArg() == 0 {
+		return nil
+	}
+	name := flag.Arg(0)
+	index := slices.IndexFunc(commands, func(cmd *command) bool { return cmd.name == name })
+	if index < 0 {
+		return &cliError{fmt.Sprintf("unknown command %q (expected generate, validate, count-tokens, list-models, or lint-schema)", name)}
+	}
+	activeCommand = commands[index]
+	flag.CommandLine.Parse(flag.Args()[1:])
+	if flag.NArg() > 0 {
+		return &cliError{fmt.Sprintf("unexpected argument %q", flag.Arg(0))}
+	}
+	return nil
+}
+
+// checkCommandFlags rejects a flag that the active command does not use, which would otherwise be
+// silently ignored
+func checkCommandFlags() error {
+	if activeCommand.flags == nil {
+		return nil
+	}
+	allowed := slices.Concat(append([][]string{commonFlags}, activeCommand.flags...)...)
+	var unused []string
+	flag.Visit(func(f *flag.Flag) {
+		if !slices.Contains(allowed, f.Name) {
+			unused = append(unused, "--"+f.Name)
+		}
+	})
+	if len(unused) > 0 {
+		return &cliError{fmt.Sprintf("%s is not used by %s (see prompt2json %s --help)", strings.Join(unused, ", "), activeCommand.name, activeCommand.name)}
+	}
+	return nil
+}
+
+// printCommandHelp prints the help of the active command
+func printCommandHelp() {
+	if activeCommand.help == "" {
+		printHelp()
+		return
+	}
+	fmt.Fprint(os.Stderr, activeCommand.help)
+}
+
+// runCommand runs the active command with the loaded configuration
+func runCommand(config *Config) error {
+	switch activeCommand {
+	case validateCommand:
+		return runValidate(config)
+	case countTokensCommand:
+		return runCountTokens(config)
+	case listModelsCommand:
+		return runListModels(config)
+	case lintSchemaCommand:
+		return runLintSchema(config)
+	default:
+		return execute(config)
+	}
+}
+
+// runValidate validates the JSON read from STDIN as if it were a generated response and writes it
+// formatted like a result
+func runValidate(config *Config) error {
+	// Error records name the input like those of a prompt read from STDIN
+	config.PromptSrc = "stdin"
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return recordFailure(config, stageValidation, &inputError{fmt.Sprintf("failed to read JSON from STDIN: %v", err)})
+	}
+	text := string(input)
+	if config.ExtractFirstJSON {
+		if start, end, ok := extractFirstJSON(text); ok {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Extract: first JSON value at bytes %d-%d of %d\n", start, end, len(text))
+			}
+			text = text[start:end]
+		} else if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Extract: no balanced JSON object or array found in %d bytes\n", len(text))
+		}
+	}
+	output, err := validateAndFormatJSON(config, text)
+	if err != nil {
+		return recordFailure(config, stageValidation, err)
+	}
+	if err := writeResult(config, output); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	return nil
+}
+
+// runCountTokens counts the prompt tokens of the requests that generate would send
+func runCountTokens(config *Config) error {
+	attachmentParts, err := loadAttachments(config)
+	if err != nil {
+		return recordFailure(config, stageAttachments, err)
+	}
+	requests, err := plannedRequests(config, attachmentParts)
+	if err != nil {
+		return recordFailure(config, stageRequest, err)
+	}
+	tokens, err := countPromptTokens(config, requests)
+	if err != nil {
+		return recordFailure(config, stageAPI, err)
+	}
+	output, err := formatJSON(config, map[string]interface{}{
+		"model":        config.Model,
+		"requests":     len(requests),
+		"promptTokens": tokens,
+	})
+	if err != nil {
+		return recordFailure(config, stageOutput, &inputError{fmt.Sprintf("failed to format token count: %v", err)})
+	}
+	if err := writeResult(config, output); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	return nil
+}
+
+// runListModels lists the models with a built-in or configured default location, price, or
+// deprecation
+func runListModels(config *Config) error {
+	locations, err := loadModelLocations(modelLocationsFile)
+	if err != nil {
+		return recordFailure(config, stageConfig, err)
+	}
+	deprecated, err := loadDeprecatedModels(deprecatedModelsFile)
+	if err != nil {
+		return recordFailure(config, stageConfig, err)
+	}
+	prices, err := loadInputPrices(priceFile)
+	if err != nil {
+		return recordFailure(config, stageConfig, err)
+	}
+
+	names := slices.Concat(slices.Collect(maps.Keys(locations)), slices.Collect(maps.Keys(deprecated)), slices.Collect(maps.Keys(prices)))
+	slices.Sort(names)
+	var models []interface{}
+	for _, name := range slices.Compact(names) {
+		model := map[string]interface{}{"model": name}
+		if location, ok := locations[name]; ok {
+			model["defaultLocation"] = location
+		}
+		if price, ok := prices[name]; ok {
+			model["pricePer1kTokens"] = price
+		}
+		if replacement, ok := deprecated[name]; ok {
+			model["replacement"] = replacement
+		}
+		models = append(models, model)
+	}
+
+	output, err := formatJSON(config, models)
+	if err != nil {
+		return recordFailure(config, stageOutput, &inputError{fmt.Sprintf("failed to format models: %v", err)})
+	}
+	if err := writeResult(config, output); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	return nil
+}
+
+// runLintSchema summarizes the schemas, which loadConfiguration has already compiled and checked
+func runLintSchema(config *Config) error {
+	schemas := make([]interface{}, len(config.CompiledSchemas))
+	for i, schema := range config.CompiledSchemas {
+		schemas[i] = map[string]interface{}{
+			"source": schema.Src,
+			"draft":  draftName(schema.Schema.Draft),
+			"sha256": schema.SHA256,
+		}
+	}
+	responseSchema, err := buildResponseSchema(config)
+	if err != nil {
+		return recordFailure(config, stageConfig, err)
+	}
+	sent, err := json.Marshal(responseSchema)
+	if err != nil {
+		return recordFailure(config, stageConfig, &inputError{fmt.Sprintf("failed to marshal schema: %v", err)})
+	}
+	config.Warnings.mu.Lock()
+	warnings := len(config.Warnings.kinds)
+	config.Warnings.mu.Unlock()
+
+	output, err := formatJSON(config, map[string]interface{}{
+		"schemas":         schemas,
+		"sentSchemaBytes": len(sent),
+		"warnings":        warnings,
+	})
+	if err != nil {
+		return recordFailure(config, stageOutput, &inputError{fmt.Sprintf("failed to format lint summary: %v", err)})
+	}
+	if err := writeResult(config, output); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveConfigValue(t *testing.T) {
+	envVars := []string{"P2J_TEST_PROJECT", "P2J_TEST_PROJECT_FALLBACK"}
+	tests := []struct {
+		name      string
+		flagValue string
+		env       map[string]string
+		want      string
+		err       string
+	}{
+		{
+			name: "nothing set",
+		},
+		{
+			name:      "flag only",
+			flagValue: "from-flag",
+			want:      "from-flag",
+		},
+		{
+			name: "first env",
+			env:  map[string]string{"P2J_TEST_PROJECT": "from-env"},
+			want: "from-env",
+		},
+		{
+			name: "second env",
+			env:  map[string]string{"P2J_TEST_PROJECT_FALLBACK": "from-fallback"},
+			want: "from-fallback",
+		},
+		{
+			name: "two agreeing envs",
+			env:  map[string]string{"P2J_TEST_PROJECT": "same", "P2J_TEST_PROJECT_FALLBACK": "same"},
+			want: "same",
+		},
+		{
+			name: "two disagreeing envs",
+			env:  map[string]string{"P2J_TEST_PROJECT": "one", "P2J_TEST_PROJECT_FALLBACK": "two"},
+			err:  "ambiguous --project: P2J_TEST_PROJECT=one and P2J_TEST_PROJECT_FALLBACK=two disagree; set --project to choose",
+		},
+		{
+			name:      "flag overrides disagreeing envs",
+			flagValue: "from-flag",
+			env:       map[string]string{"P2J_TEST_PROJECT": "one", "P2J_TEST_PROJECT_FALLBACK": "two"},
+			want:      "from-flag",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, envVar := range envVars {
+				t.Setenv(envVar, tt.env[envVar])
+			}
+			got, err := resolveConfigValue("project", tt.flagValue, envVars...)
+			if tt.err != "" {
+				if _, ok := err.(*cliError); !ok || err.Error() != tt.err {
+					t.Fatalf("error = %#v, want cliError %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("value = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// loadTestConfiguration runs loadConfiguration with a fresh flag set parsed from args
+func loadTestConfiguration(t *testing.T, args []string) (*Config, error) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("prompt2json", flag.ContinueOnError)
+	templateVars, schemaFiles, promptFiles, attachments, scopes = nil, nil, nil, nil, nil
+	verboseCount = 0
+	defineFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatalf("invalid test arguments: %v", err)
+	}
+	return loadConfiguration()
+}
+
+func TestLoadConfigurationSources(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"schema.json":     `{"type": "object"}`,
+		"instruction.txt": "Instruction from file\n",
+		"prompt.txt":      "Prompt from file\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	schemaFile := filepath.Join(dir, "schema.json")
+	instructionFile := filepath.Join(dir, "instruction.txt")
+	promptFile := filepath.Join(dir, "prompt.txt")
+
+	tests := []struct {
+		name                 string
+		args                 []string
+		env                  map[string]string
+		err                  string
+		schemaSrc            string
+		systemInstruction    string
+		systemInstructionSrc string
+		prompt               string
+		promptSrc            string
+		project              string
+		location             string
+	}{
+		{
+			name:      "schema from flag",
+			args:      []string{"--schema", `{"type": "object"}`},
+			schemaSrc: "flag",
+		},
+		{
+			name:      "schema from file",
+			args:      []string{"--schema-file", schemaFile},
+			schemaSrc: schemaFile,
+		},
+		{
+			name:      "schema from env",
+			args:      []string{"--schema-env", "P2J_TEST_SCHEMA"},
+			env:       map[string]string{"P2J_TEST_SCHEMA": `{"type": "object"}`},
+			schemaSrc: "env:P2J_TEST_SCHEMA",
+		},
+		{
+			name: "schema flag and file",
+			args: []string{"--schema", `{}`, "--schema-file", schemaFile},
+			err:  "cannot specify both --schema and --schema-file",
+		},
+		{
+			name: "schema env and flag",
+			args: []string{"--schema-env", "P2J_TEST_SCHEMA", "--schema", `{}`},
+			env:  map[string]string{"P2J_TEST_SCHEMA": `{}`},
+			err:  "--schema-env P2J_TEST_SCHEMA cannot be combined with --schema",
+		},
+		{
+			name: "schema env and file",
+			args: []string{"--schema-env", "P2J_TEST_SCHEMA", "--schema-file", schemaFile},
+			env:  map[string]string{"P2J_TEST_SCHEMA": `{}`},
+			err:  "--schema-env P2J_TEST_SCHEMA cannot be combined with --schema-file",
+		},
+		{
+			name: "schema env not set",
+			args: []string{"--schema-env", "P2J_TEST_SCHEMA"},
+			err:  "environment variable P2J_TEST_SCHEMA named by --schema-env is not set",
+		},
+		{
+			name:                 "system instruction from flag",
+			args:                 []string{"--system-instruction", " Instruction from flag "},
+			systemInstruction:    "Instruction from flag",
+			systemInstructionSrc: "flag",
+		},
+		{
+			name:                 "system instruction from file",
+			args:                 []string{"--system-instruction-file", instructionFile},
+			systemInstruction:    "Instruction from file",
+			systemInstructionSrc: instructionFile,
+		},
+		{
+			name:                 "system instruction from env",
+			args:                 []string{"--system-instruction-env", "P2J_TEST_INSTRUCTION"},
+			env:                  map[string]string{"P2J_TEST_INSTRUCTION": "Instruction from env"},
+			systemInstruction:    "Instruction from env",
+			systemInstructionSrc: "env:P2J_TEST_INSTRUCTION",
+		},
+		{
+			name: "system instruction flag and file",
+			args: []string{"--system-instruction", "x", "--system-instruction-file", instructionFile},
+			err:  "cannot specify both --system-instruction and --system-instruction-file",
+		},
+		{
+			name: "system instruction env and flag",
+			args: []string{"--system-instruction-env", "P2J_TEST_INSTRUCTION", "--system-instruction", "x"},
+			env:  map[string]string{"P2J_TEST_INSTRUCTION": "x"},
+			err:  "--system-instruction-env P2J_TEST_INSTRUCTION cannot be combined with --system-instruction",
+		},
+		{
+			name: "system instruction env and file",
+			args: []string{"--system-instruction-env", "P2J_TEST_INSTRUCTION", "--system-instruction-file", instructionFile},
+			env:  map[string]string{"P2J_TEST_INSTRUCTION": "x"},
+			err:  "--system-instruction-env P2J_TEST_INSTRUCTION cannot be combined with --system-instruction-file",
+		},
+		{
+			name: "system instruction template and file",
+			args: []string{"--system-instruction-template", instructionFile, "--system-instruction-file", instructionFile},
+			err:  "--system-instruction-template cannot be combined with --system-instruction-file",
+		},
+		{
+			name:      "prompt from flag",
+			args:      []string{"--prompt", "Prompt from flag"},
+			prompt:    "Prompt from flag",
+			promptSrc: "flag",
+		},
+		{
+			name:      "prompt from file",
+			args:      []string{"--prompt-file", promptFile},
+			prompt:    "Prompt from file",
+			promptSrc: promptFile,
+		},
+		{
+			name:      "prompt from env",
+			args:      []string{"--prompt-env", "P2J_TEST_PROMPT"},
+			env:       map[string]string{"P2J_TEST_PROMPT": "Prompt from env"},
+			prompt:    "Prompt from env",
+			promptSrc: "env:P2J_TEST_PROMPT",
+		},
+		{
+			name: "prompt flag and file",
+			args: []string{"--prompt", "x", "--prompt-file", promptFile},
+			err:  "cannot specify both --prompt and --prompt-file",
+		},
+		{
+			name: "prompt env and flag",
+			args: []string{"--prompt-env", "P2J_TEST_PROMPT", "--prompt", "x"},
+			env:  map[string]string{"P2J_TEST_PROMPT": "x"},
+			err:  "--prompt-env P2J_TEST_PROMPT cannot be combined with --prompt",
+		},
+		{
+			name: "prompt env and file",
+			args: []string{"--prompt-env", "P2J_TEST_PROMPT", "--prompt-file", promptFile},
+			env:  map[string]string{"P2J_TEST_PROMPT": "x"},
+			err:  "--prompt-env P2J_TEST_PROMPT cannot be combined with --prompt-file",
+		},
+		{
+			name:     "project and location from the first env",
+			env:      map[string]string{"GOOGLE_CLOUD_PROJECT": "env-project", "GOOGLE_CLOUD_LOCATION": "europe-west4"},
+			project:  "env-project",
+			location: "europe-west4",
+		},
+		{
+			name:     "project and location from fallback envs",
+			env:      map[string]string{"CLOUDSDK_CORE_PROJECT": "sdk-project", "CLOUDSDK_COMPUTE_REGION": "europe-west4"},
+			project:  "sdk-project",
+			location: "europe-west4",
+		},
+		{
+			name:     "flags override envs",
+			args:     []string{"--project", "flag-project", "--location", "us-east1"},
+			env:      map[string]string{"GOOGLE_CLOUD_PROJECT": "env-project", "CLOUDSDK_CORE_PROJECT": "sdk-project", "GOOGLE_CLOUD_LOCATION": "europe-west4"},
+			project:  "flag-project",
+			location: "us-east1",
+		},
+		{
+			name: "disagreeing project envs",
+			env:  map[string]string{"GOOGLE_CLOUD_PROJECT": "env-project", "CLOUDSDK_CORE_PROJECT": "sdk-project"},
+			err:  "ambiguous --project: GOOGLE_CLOUD_PROJECT=env-project and CLOUDSDK_CORE_PROJECT=sdk-project disagree; set --project to choose",
+		},
+		{
+			name: "disagreeing location envs",
+			env:  map[string]string{"GOOGLE_CLOUD_REGION": "us-east1", "CLOUDSDK_COMPUTE_REGION": "europe-west4"},
+			err:  "ambiguous --location: GOOGLE_CLOUD_REGION=us-east1 and CLOUDSDK_COMPUTE_REGION=europe-west4 disagree; set --location to choose",
+		},
+	}
+
+	envVars := []string{
+		"P2J_TEST_SCHEMA", "P2J_TEST_INSTRUCTION", "P2J_TEST_PROMPT",
+		"GOOGLE_CLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT", "GOOGLE_CLOUD_QUOTA_PROJECT",
+		"GOOGLE_CLOUD_LOCATION", "GOOGLE_CLOUD_REGION", "CLOUDSDK_COMPUTE_REGION",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, envVar := range envVars {
+				if value, ok := tt.env[envVar]; ok {
+					t.Setenv(envVar, value)
+				} else {
+					// Setenv restores the variable afterwards, and unsetting it hides it from LookupEnv
+					t.Setenv(envVar, "")
+					os.Unsetenv(envVar)
+				}
+			}
+
+			// Every required input not under test comes from a flag
+			args := append([]string{"--model", "gemini-2.5-flash"}, tt.args...)
+			for _, defaults := range [][]string{
+				{"--schema", `{"type": "object"}`},
+				{"--system-instruction", "x"},
+				{"--prompt", "x"},
+			} {
+				if !slices.ContainsFunc(tt.args, func(arg string) bool { return strings.HasPrefix(arg, defaults[0]) }) {
+					args = append(args, defaults...)
+				}
+			}
+			if !slices.Contains(tt.args, "--project") && tt.env["GOOGLE_CLOUD_PROJECT"] == "" && tt.env["CLOUDSDK_CORE_PROJECT"] == "" {
+				args = append(args, "--project", "default-project")
+			}
+			if !slices.Contains(tt.args, "--location") && tt.env["GOOGLE_CLOUD_LOCATION"] == "" && tt.env["GOOGLE_CLOUD_REGION"] == "" && tt.env["CLOUDSDK_COMPUTE_REGION"] == "" {
+				args = append(args, "--location", "us-central1")
+			}
+
+			config, err := loadTestConfiguration(t, args)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, check := range []struct{ field, got, want string }{
+				{"SchemaSrc", config.SchemaSrc, tt.schemaSrc},
+				{"SystemInstruction", config.SystemInstruction, tt.systemInstruction},
+				{"SystemInstructionSrc", config.SystemInstructionSrc, tt.systemInstructionSrc},
+				{"Prompt", config.Prompt, tt.prompt},
+				{"PromptSrc", config.PromptSrc, tt.promptSrc},
+				{"Project", config.Project, tt.project},
+				{"Location", config.Location, tt.location},
+			} {
+				if check.want != "" && check.got != check.want {
+					t.Errorf("%s = %q, want %q", check.field, check.got, check.want)
+				}
+			}
+		})
+	}
+}
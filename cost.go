@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Built-in input prices in USD per 1,000 prompt tokens, used by --estimate-cost for models that
+// are not listed in the --price-file. Prices change over time; the price file takes precedence.
+var modelInputPricesPer1K = map[string]float64{
+	"gemini-2.5-pro":        0.00125,
+	"gemini-2.5-flash":      0.0003,
+	"gemini-2.5-flash-lite": 0.0001,
+	"gemini-2.0-flash":      0.00015,
+	"gemini-2.0-flash-lite": 0.000075,
+}
+
+// loadInputPrices returns the built-in prices merged with the entries of the --price-file, a JSON
+// object of model names to the USD price per 1,000 prompt tokens
+func loadInputPrices(path string) (map[string]float64, error) {
+	prices := make(map[string]float64, len(modelInputPricesPer1K))
+	for model, price := range modelInputPricesPer1K {
+		prices[model] = price
+	}
+	if path == "" {
+		return prices, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read price file: %v", err)}
+	}
+	var overrides map[string]float64
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid price file (expected a JSON object of model names to prices per 1,000 tokens): %v", err)}
+	}
+	for model, price := range overrides {
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// plannedRequests builds the body of every generateContent request the configuration would send:
+// one per PDF chunk, one per prompt split from STDIN, or a single request
+func plannedRequests(config *Config, attachmentParts []interface{}) ([][]byte, error) {
+	if len(config.PDFChunkParts) > 0 {
+		var requests [][]byte
+		for _, chunkPart := range config.PDFChunkParts {
+			parts := make([]interface{}, 0, len(attachmentParts)+1)
+			parts = append(parts, attachmentParts[:config.PDFChunkIndex]...)
+			parts = append(parts, chunkPart)
+			parts = append(parts, attachmentParts[config.PDFChunkIndex:]...)
+			request, err := buildGeminiRequest(config, parts)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, request)
+		}
+		return requests, nil
+	}
+
+	if len(config.Prompts) > 0 {
+		var requests [][]byte
+		for _, itemPrompt := range config.Prompts {
+			itemConfig := *config
+			itemConfig.Prompt = itemPrompt
+			request, err := buildGeminiRequest(&itemConfig, attachmentParts)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, request)
+		}
+		return requests, nil
+	}
+
+	request, err := buildGeminiRequest(config, attachmentParts)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{request}, nil
+}
+
+// countPromptTokens returns the total prompt tokens of the requests, counted with the countTokens
+// endpoint of the configured model
+func countPromptTokens(config *Config, requests [][]byte) (int, error) {
+	url := strings.TrimSuffix(buildGeminiURL(config), ":generateContent") + ":countTokens"
+	totalTokens := 0
+	for _, request := range requests {
+		respBody, err := postVertexAI(config, url, request)
+		if err != nil {
+			return 0, withRequestID(err, config.RequestID)
+		}
+		var countResp struct {
+			TotalTokens int `json:"totalTokens"`
+		}
+		if err := json.Unmarshal(respBody, &countResp); err != nil {
+			return 0, &apiError{message: fmt.Sprintf("failed to parse countTokens response: %v", err)}
+		}
+		totalTokens += countResp.TotalTokens
+	}
+
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Token count: %d prompt tokens in %d requests\n", totalTokens, len(requests))
+	}
+	return totalTokens, nil
+}
+
+// estimateCost counts the prompt tokens of each planned request with the countTokens endpoint and
+// writes the estimated prompt cost without generating anything. Output tokens are not included
+// since they are only known once the response has been generated.
+func estimateCost(config *Config, requests [][]byte) (string, error) {
+	prices, err := loadInputPrices(config.PriceFile)
+	if err != nil {
+		return "", err
+	}
+	price, ok := prices[config.Model]
+	if !ok {
+		return "", &cliError{fmt.Sprintf("no price is known for model %s; provide it with --price-file", config.Model)}
+	}
+
+	totalTokens, err := countPromptTokens(config, requests)
+	if err != nil {
+		return "", err
+	}
+
+	estimate := map[string]interface{}{
+		"model":            config.Model,
+		"requests":         len(requests),
+		"promptTokens":     totalTokens,
+		"pricePer1kTokens": price,
+		"estimatedCost":    float64(totalTokens) / 1000 * price,
+		"currency":         "USD",
+	}
+	return formatJSON(config, estimate)
+}
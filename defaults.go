@@ -0,0 +1,77 @@
+package main
+
+// applySchemaDefaults fills the members of value that are declared in the schema's properties but
+// absent, using each property's default annotation, and descends into the members and items that
+// are present. Objects and arrays are updated in place; inserted defaults are copies and are not
+// descended into. The number of defaults inserted is returned.
+func applySchemaDefaults(root, schema map[string]interface{}, value interface{}) int {
+	schema = followLocalRefs(root, schema)
+	applied := 0
+	for _, subschema := range schemaList(schema["allOf"]) {
+		if subschema != nil {
+			applied += applySchemaDefaults(root, subschema, value)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for key, member := range v {
+			memberSchema, ok := properties[key].(map[string]interface{})
+			if !ok {
+				memberSchema = additional
+			}
+			if memberSchema != nil {
+				applied += applySchemaDefaults(root, memberSchema, member)
+			}
+		}
+		for name, property := range properties {
+			propertySchema, ok := property.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			propertySchema = followLocalRefs(root, propertySchema)
+			defaultValue, hasDefault := propertySchema["default"]
+			if _, present := v[name]; present || !hasDefault {
+				continue
+			}
+			v[name] = copyJSON(defaultValue)
+			applied++
+		}
+	case []interface{}:
+		prefixItems := schemaList(schema["prefixItems"])
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range v {
+			itemSchema := items
+			if i < len(prefixItems) {
+				itemSchema = prefixItems[i]
+			}
+			if itemSchema != nil {
+				applied += applySchemaDefaults(root, itemSchema, item)
+			}
+		}
+	}
+	return applied
+}
+
+// copyJSON returns a deep copy of a decoded JSON value so that a default inserted into a result
+// never shares containers with the schema
+func copyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, member := range v {
+			copied[key] = copyJSON(member)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyJSON(item)
+		}
+		return copied
+	default:
+		return value
+	}
+}
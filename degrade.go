@@ -0,0 +1,69 @@
+package main
+
+// Keywords removed by --degrade-schema. They constrain the values of the response rather than its
+// structure, so the degraded schema still requires the same types, properties, and items.
+var degradedKeywords = map[string]bool{
+	"enum":             true,
+	"const":            true,
+	"pattern":          true,
+	"format":           true,
+	"minimum":          true,
+	"maximum":          true,
+	"exclusiveMinimum": true,
+	"exclusiveMaximum": true,
+	"multipleOf":       true,
+	"minLength":        true,
+	"maxLength":        true,
+	"minItems":         true,
+	"maxItems":         true,
+	"uniqueItems":      true,
+	"minContains":      true,
+	"maxContains":      true,
+	"minProperties":    true,
+	"maxProperties":    true,
+}
+
+// degradeSchema returns a copy of the schema with the degradedKeywords removed from it and from
+// every subschema. Only keywords that hold subschemas are descended into, so a property whose name
+// matches a removed keyword is kept.
+func degradeSchema(schema map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(schema))
+	for key, value := range schema {
+		if !degradedKeywords[key] {
+			result[key] = value
+		}
+	}
+
+	for _, keyword := range subschemaKeywords {
+		if subschema, ok := schema[keyword].(map[string]interface{}); ok {
+			result[keyword] = degradeSchema(subschema)
+		}
+	}
+	for _, keyword := range subschemaArrayKeywords {
+		if subschemas, ok := schema[keyword].([]interface{}); ok {
+			converted := make([]interface{}, len(subschemas))
+			for i, item := range subschemas {
+				if subschema, ok := item.(map[string]interface{}); ok {
+					converted[i] = degradeSchema(subschema)
+				} else {
+					converted[i] = item
+				}
+			}
+			result[keyword] = converted
+		}
+	}
+	for _, keyword := range subschemaMapKeywords {
+		if named, ok := schema[keyword].(map[string]interface{}); ok {
+			converted := make(map[string]interface{}, len(named))
+			for name, item := range named {
+				if subschema, ok := item.(map[string]interface{}); ok {
+					converted[name] = degradeSchema(subschema)
+				} else {
+					converted[name] = item
+				}
+			}
+			result[keyword] = converted
+		}
+	}
+	return result
+}
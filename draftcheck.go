@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Drafts accepted by --validate-only-against-draft, by the name used in their $schema URL
+var schemaDrafts = map[string]*jsonschema.Draft{
+	"4":       jsonschema.Draft4,
+	"6":       jsonschema.Draft6,
+	"7":       jsonschema.Draft7,
+	"2019-09": jsonschema.Draft2019,
+	"2020-12": jsonschema.Draft2020,
+}
+
+// parseSchemaDraft parses a --validate-only-against-draft value, also accepting names written as
+// in the older $schema URLs, such as draft-07
+func parseSchemaDraft(name string) (*jsonschema.Draft, error) {
+	draft, ok := schemaDrafts[strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(name), "draft-"), "0")]
+	if !ok {
+		return nil, &cliError{fmt.Sprintf("invalid --validate-only-against-draft %q (expected 4, 6, 7, 2019-09, or 2020-12)", name)}
+	}
+	return draft, nil
+}
+
+func draftName(draft *jsonschema.Draft) string {
+	for name, d := range schemaDrafts {
+		if d == draft {
+			return name
+		}
+	}
+	return draft.String()
+}
+
+// compileCrossCheckSchema compiles a validation schema a second time under the draft of
+// --validate-only-against-draft. The top-level $schema is removed first, since it would otherwise
+// select the draft it declares.
+func compileCrossCheckSchema(config *Config, src string, schemaBytes []byte, primary *jsonschema.Schema) (*jsonschema.Schema, error) {
+	if primary.Draft == config.CrossCheckDraft {
+		return nil, &cliError{fmt.Sprintf("schema %s is already validated under draft %s; --validate-only-against-draft needs another draft", src, draftName(primary.Draft))}
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid JSON in schema %s: %v", src, err)}
+	}
+	delete(schema, "$schema")
+	content, err := json.Marshal(schema)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to marshal schema %s: %v", src, err)}
+	}
+
+	compiler := newSchemaCompiler(config, config.CrossCheckDraft)
+	if err := compiler.AddResource(schemaValidationURL, bytes.NewReader(content)); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid JSON Schema %s under draft %s: %v", src, draftName(config.CrossCheckDraft), err)}
+	}
+	compiled, err := compiler.Compile(schemaValidationURL)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("%s does not compile under draft %s: %v", src, draftName(config.CrossCheckDraft), err)}
+	}
+	return compiled, nil
+}
+
+// logDraftDivergence reports to STDERR where validating under the cross-check draft gives a
+// different result than the validation that decides the run: one passes and the other fails, or
+// both fail at different locations or keywords. It never changes the outcome.
+func logDraftDivergence(config *Config, schema compiledSchema, target interface{}, primaryErr error) {
+	crossErr := schema.CrossCheck.Validate(target)
+	primaryDraft, crossDraft := draftName(schema.Schema.Draft), draftName(schema.CrossCheck.Draft)
+
+	switch {
+	case primaryErr == nil && crossErr == nil:
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Draft cross-check: %s passes under both draft %s and draft %s\n", schema.Src, primaryDraft, crossDraft)
+		}
+	case primaryErr == nil:
+		config.Log.Printf("Draft cross-check: %s passes under draft %s but fails under draft %s: %s\n",
+			schema.Src, primaryDraft, crossDraft, describeValidationFailure(crossErr, config.ValidatePointer, config.MaxErrors))
+	case crossErr == nil:
+		config.Log.Printf("Draft cross-check: %s fails under draft %s but passes under draft %s\n", schema.Src, primaryDraft, crossDraft)
+	default:
+		primaryIssues, crossIssues := crossCheckIssues(primaryErr, config.ValidatePointer), crossCheckIssues(crossErr, config.ValidatePointer)
+		if slices.Equal(primaryIssues, crossIssues) {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Draft cross-check: %s fails the same way under draft %s and draft %s\n", schema.Src, primaryDraft, crossDraft)
+			}
+			return
+		}
+		config.Log.Printf("Draft cross-check: %s fails differently under draft %s (%s) and draft %s (%s)\n",
+			schema.Src, primaryDraft, strings.Join(primaryIssues, ", "), crossDraft, strings.Join(crossIssues, ", "))
+	}
+}
+
+// crossCheckIssues returns the sorted locations and keywords of a validation error's failures,
+// leaving out the messages, which differ between drafts for the same failure
+func crossCheckIssues(err error, pointer string) []string {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var issues []string
+	for _, issue := range rankValidationIssues(validationErr, pointer) {
+		if key := issue.Location + ": " + issue.Keyword; !slices.Contains(issues, key) {
+			issues = append(issues, key)
+		}
+	}
+	slices.Sort(issues)
+	return issues
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Modes of --use-embedded-schema
+const (
+	embeddedSchemaAlso    = "also"    // Validate against the response's $schema as well as the provided schemas
+	embeddedSchemaInstead = "instead" // Validate against the response's $schema only
+)
+
+// Schemas named by the $schema of responses, compiled once per URL for the lifetime of the process
+var (
+	embeddedSchemaCacheMu sync.Mutex
+	embeddedSchemaCache   = map[string]*jsonschema.Schema{}
+)
+
+// loadEmbeddedSchema compiles the schema that a response names in its top-level $schema member for
+// --use-embedded-schema. The URL comes from the model's output, so only http and https URLs are
+// fetched, never local files, and every problem with it is a validation failure of the response.
+func loadEmbeddedSchema(config *Config, target interface{}) (compiledSchema, error) {
+	object, _ := target.(map[string]interface{})
+	url, ok := object["$schema"].(string)
+	if !ok {
+		return compiledSchema{}, &validationError{"response has no top-level $schema string to validate against (--use-embedded-schema)"}
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return compiledSchema{}, &validationError{fmt.Sprintf("response $schema %q is not an http or https URL (--use-embedded-schema)", url)}
+	}
+
+	embeddedSchemaCacheMu.Lock()
+	defer embeddedSchemaCacheMu.Unlock()
+	schema, ok := embeddedSchemaCache[url]
+	if !ok {
+		compiled, err := newSchemaCompiler(config, jsonschema.Draft2020).Compile(url)
+		if err != nil {
+			return compiledSchema{}, &validationError{fmt.Sprintf("response $schema %s cannot be used for validation: %v", url, err)}
+		}
+		embeddedSchemaCache[url] = compiled
+		schema = compiled
+	}
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Validation: validating against the response's $schema %s\n", url)
+	}
+	return compiledSchema{Src: url, Schema: schema}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "encoding/json"
+
+// extractFirstJSON finds the first balanced top-level JSON object or array in text for
+// --extract-first-json and returns its byte range. Brackets inside strings are ignored. A balanced
+// candidate that is not valid JSON, such as prose in braces, is skipped and the search resumes
+// after its opening bracket.
+func extractFirstJSON(text string) (start, end int, ok bool) {
+	for start = 0; start < len(text); start++ {
+		if text[start] != '{' && text[start] != '[' {
+			continue
+		}
+		if end, ok = balancedJSONEnd(text, start); ok && json.Valid([]byte(text[start:end])) {
+			return start, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+// balancedJSONEnd returns the offset just past the bracket that closes the one at start
+func balancedJSONEnd(text string, start int) (int, bool) {
+	var closers []byte
+	inString := false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			closers = append(closers, '}')
+		case '[':
+			closers = append(closers, ']')
+		case '}', ']':
+			if closers[len(closers)-1] != c {
+				return 0, false
+			}
+			closers = closers[:len(closers)-1]
+			if len(closers) == 0 {
+				return i + 1, true
+			}
+		}
+	}
+	return 0, false
+}
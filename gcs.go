@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Prefix of --attach paths that name a Cloud Storage object
+const gcsURIPrefix = "gs://"
+
+// Cloud Storage JSON API endpoint that objects are downloaded from
+const gcsDownloadURL = "https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media"
+
+// downloadGCSObject downloads the content of a gs://bucket/object URI using the same credentials
+// as the API calls. A limit above zero bounds how many bytes are read; content that exceeds it is
+// an error rather than being truncated.
+func downloadGCSObject(config *Config, uri string, limit int64) ([]byte, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(uri, gcsURIPrefix), "/")
+	if !ok || bucket == "" || object == "" {
+		return nil, &inputError{fmt.Sprintf("invalid Cloud Storage URI %s (expected gs://BUCKET/OBJECT)", uri)}
+	}
+
+	if config.Session == nil {
+		session, err := newAPISession(config)
+		if err != nil {
+			return nil, err
+		}
+		config.Session = session
+	}
+	session := config.Session
+
+	token, err := fetchToken(config, session)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadURL := fmt.Sprintf(gcsDownloadURL, url.PathEscape(bucket), url.PathEscape(object))
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Request: GET %s\n", downloadURL)
+	}
+	req, err := http.NewRequestWithContext(session.ctx, "GET", downloadURL, nil)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to create download request for %s: %v", uri, err)}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	if config.QuotaProject != "" {
+		req.Header.Set("X-Goog-User-Project", config.QuotaProject)
+	}
+
+	resp, err := session.client.Do(req)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to download attachment %s: %v", uri, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Error bodies are short JSON messages, so only a bounded prefix is kept
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		message := fmt.Sprintf("failed to download attachment %s: status %d: %s", uri, resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, &authError{fmt.Sprintf("%s (the credentials need storage.objects.get on the bucket)", message)}
+		}
+		return nil, &inputError{message}
+	}
+
+	reader := io.Reader(resp.Body)
+	if limit > 0 {
+		// Read one byte past the limit to detect an object that exceeds it
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to download attachment %s: %v", uri, err)}
+	}
+	if limit > 0 && int64(len(content)) > limit {
+		return nil, &inputError{fmt.Sprintf("attachment %s exceeds the %d MB limit for inline data", uri, limit/(1024*1024))}
+	}
+	return content, nil
+}
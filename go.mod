@@ -3,9 +3,22 @@ module github.com/UnitVectorY-Labs/prompt2json
 go 1.25.6 // GOVERSION
 
 require (
+	cloud.google.com/go/compute/metadata v0.3.0
 	github.com/UnitVectorY-Labs/gcpvalidate v0.1.1
+	github.com/pdfcpu/pdfcpu v0.11.1
 	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	golang.org/x/oauth2 v0.34.0
 )
 
-require cloud.google.com/go/compute/metadata v0.3.0 // indirect
+require (
+	github.com/clipperhouse/uax29/v2 v2.2.0 // indirect
+	github.com/hhrutter/lzw v1.0.0 // indirect
+	github.com/hhrutter/pkcs7 v0.2.0 // indirect
+	github.com/hhrutter/tiff v1.0.2 // indirect
+	github.com/mattn/go-runewidth v0.0.19 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/image v0.32.0 // indirect
+	golang.org/x/text v0.30.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens.
+// The empty pointer refers to the whole document and yields no tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON Pointer must be empty or start with '/': %s", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		// ~1 must be decoded before ~0 so that "~01" becomes "~1" rather than "/"
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// escapeJSONPointerToken escapes a member name for use as a reference token
+func escapeJSONPointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// resolveJSONPointer returns the value the reference tokens point to within a decoded JSON document
+func resolveJSONPointer(document interface{}, tokens []string) (interface{}, error) {
+	current := document
+	for i, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q at /%s", token, strings.Join(tokens[:i], "/"))
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+				return nil, fmt.Errorf("invalid array index %q at /%s", token, strings.Join(tokens[:i], "/"))
+			}
+			if index >= len(node) {
+				return nil, fmt.Errorf("array index %d out of range at /%s", index, strings.Join(tokens[:i], "/"))
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("cannot descend into a scalar value at /%s", strings.Join(tokens[:i], "/"))
+		}
+	}
+	return current, nil
+}
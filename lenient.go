@@ -0,0 +1,90 @@
+package main
+
+// relaxJSON rewrites hand-authored JSON for --lenient-schema-json: // line comments and /* */ block
+// comments are removed and a comma directly before a closing } or ] is dropped. Strings are copied
+// unchanged, so comment markers and commas inside them are kept. Anything else that is not JSON is
+// left for the parser to report.
+func relaxJSON(content []byte) []byte {
+	return dropTrailingCommas(stripJSONComments(content))
+}
+
+func stripJSONComments(content []byte) []byte {
+	out := make([]byte, 0, len(content))
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if inString {
+			out = append(out, c)
+			if c == '\\' && i+1 < len(content) {
+				i++
+				out = append(out, content[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '/' && i+1 < len(content) && content[i+1] == '/' {
+			// The newline is kept so that parse errors still point at the right line
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			if i < len(content) {
+				out = append(out, '\n')
+			}
+			continue
+		}
+		if c == '/' && i+1 < len(content) && content[i+1] == '*' {
+			i += 2
+			for i < len(content) && !(content[i] == '*' && i+1 < len(content) && content[i+1] == '/') {
+				if content[i] == '\n' {
+					out = append(out, '\n')
+				}
+				i++
+			}
+			i++ // Skip the closing slash
+			out = append(out, ' ')
+			continue
+		}
+		if c == '"' {
+			inString = true
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func dropTrailingCommas(content []byte) []byte {
+	out := make([]byte, 0, len(content))
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		if inString {
+			out = append(out, c)
+			if c == '\\' && i+1 < len(content) {
+				i++
+				out = append(out, content[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == ',' {
+			next := i + 1
+			for next < len(content) && isJSONWhitespace(content[next]) {
+				next++
+			}
+			if next < len(content) && (content[next] == '}' || content[next] == ']') {
+				continue
+			}
+		}
+		if c == '"' {
+			inString = true
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func isJSONWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger writes diagnostic messages to STDERR (or another writer) while holding a lock so that
+// messages from concurrent workers are never interleaved mid-line. Loggers derived with
+// withPrefix share the lock and writers of their parent.
+type logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	file   io.Writer // Receives a JSON record per message with --log-file; nil disables
+	system io.Writer // Receives each message as a system log entry with --syslog; nil disables
+	id     string
+	prefix string
+}
+
+// logRecord is one line of the --log-file
+type logRecord struct {
+	Timestamp string `json:"timestamp"`
+	RequestID string `json:"requestId,omitempty"`
+	Stage     string `json:"stage,omitempty"`
+	Message   string `json:"message"`
+}
+
+// A message that starts with a short label such as "Validation: " or "Retry: " is attributed to
+// that stage in the structured log
+var logStagePattern = regexp.MustCompile(`^([A-Z][A-Za-z ]{0,30}): `)
+
+func newLogger(out io.Writer) *logger {
+	return &logger{mu: &sync.Mutex{}, out: out}
+}
+
+// withFile returns a logger that also writes every message as a JSON record to file
+func (l *logger) withFile(file io.Writer) *logger {
+	return &logger{mu: l.mu, out: l.out, file: file, system: l.system, id: l.id, prefix: l.prefix}
+}
+
+// withSystem returns a logger that also writes every message to the system log
+func (l *logger) withSystem(system io.Writer) *logger {
+	return &logger{mu: l.mu, out: l.out, file: l.file, system: system, id: l.id, prefix: l.prefix}
+}
+
+// withPrefix returns a logger that prefixes every line with the given id, such as a batch item id
+func (l *logger) withPrefix(id string) *logger {
+	return &logger{mu: l.mu, out: l.out, file: l.file, system: l.system, id: id, prefix: fmt.Sprintf("[%s] ", id)}
+}
+
+// Printf formats a message and writes it as a single unit; multi-line messages are kept together
+// and each line receives the logger's prefix
+func (l *logger) Printf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	text := message
+	if l.prefix != "" {
+		lines := strings.SplitAfter(message, "\n")
+		var prefixed strings.Builder
+		for _, line := range lines {
+			if line != "" {
+				prefixed.WriteString(l.prefix)
+				prefixed.WriteString(line)
+			}
+		}
+		text = prefixed.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, text)
+	l.writeRecord(message)
+	l.writeSystem(text)
+}
+
+// Record writes a message to the --log-file and the system log only, for diagnostics that are
+// printed to STDERR elsewhere
+func (l *logger) Record(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writeRecord(message)
+	l.writeSystem(l.prefix + message)
+}
+
+// writeSystem writes a message as a single system log entry; the caller holds the lock
+func (l *logger) writeSystem(text string) {
+	if l.system != nil {
+		io.WriteString(l.system, strings.TrimRight(text, "\n"))
+	}
+}
+
+// writeRecord writes the structured copy of a message; the caller holds the lock
+func (l *logger) writeRecord(message string) {
+	if l.file == nil {
+		return
+	}
+	record := logRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: l.id,
+		Message:   strings.TrimRight(message, "\n"),
+	}
+	if match := logStagePattern.FindStringSubmatch(record.Message); match != nil {
+		record.Stage = match[1]
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.file.Write(append(line, '\n'))
+}
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"cloud.google.com/go/compute/metadata"
 	"github.com/UnitVectorY-Labs/gcpvalidate/location"
 	"github.com/UnitVectorY-Labs/gcpvalidate/project"
 	"github.com/UnitVectorY-Labs/gcpvalidate/vertexai"
 	"github.com/santhosh-tekuri/jsonschema/v5"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
@@ -32,39 +46,248 @@ const (
 	exitInputError      = 3
 	exitValidationError = 4
 	exitAPIError        = 5
+	exitQuotaError      = 6
+	exitAuthError       = 7
+	exitConfidenceError = 8
+	exitDriftError      = 9
+	exitWarningError    = 10
 )
 
+// Finish reasons that stop generation for policy reasons and can never be accepted with
+// --accept-finish-reasons
+var nonOverridableFinishReasons = []string{"SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY"}
+
+// Finish reasons documented for the API when this version was released; any other value is logged
+// as unrecognized and can be retried with --retry-unknown-finish
+var knownFinishReasons = append([]string{
+	"FINISH_REASON_UNSPECIFIED", "STOP", "MAX_TOKENS", "OTHER", "LANGUAGE", "MALFORMED_FUNCTION_CALL",
+	"UNEXPECTED_TOOL_CALL", "TOO_MANY_TOOL_CALLS", "IMAGE_PROHIBITED_CONTENT", "IMAGE_RECITATION", "IMAGE_OTHER",
+}, nonOverridableFinishReasons...)
+
+// Sources of the access token selected with --credentials-source
+const (
+	credentialsSourceADC      = "adc"
+	credentialsSourceMetadata = "metadata"
+	credentialsSourceFile     = "file"
+)
+
+// OAuth scope of the access token used for Vertex AI unless --scope is set
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Prefix of a full OAuth scope URL, added to a --scope given by its short name
+const oauthScopePrefix = "https://www.googleapis.com/auth/"
+
+// Hint appended to authentication and permission errors
+const authErrorHint = "run 'gcloud auth application-default login' or verify the service account has the Vertex AI User role (roles/aiplatform.user)"
+
+// Processing stages reported in error records
+const (
+	stageConfig      = "config"
+	stageAttachments = "attachments"
+	stageRequest     = "request"
+	stageAPI         = "api"
+	stageValidation  = "validation"
+	stageTransform   = "transform"
+	stageOutput      = "output"
+)
+
+// Argument of --attach or --schema that reads the content from STDIN
+const stdinPath = "-"
+
+// Retry backoff: the delay doubles after each attempt, starting at the base delay and capped at the max
+const (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// Formats for combining the results of multiple prompts split from STDIN
+const (
+	resultsFormatNDJSON = "ndjson"
+	resultsFormatArray  = "array"
+)
+
+// Text of the trailing part added by --no-cache-prompt, formatted as a comment so the model treats
+// it as markup rather than part of the task
+const promptNonceFormat = "<!-- nonce: %s -->"
+
+// Verbosity levels of the diagnostics written to STDERR; each level includes those below it
+const (
+	verbosityConfig  = 1 // Configuration summary: sources and sizes of the inputs, schemas, attachments, and API settings
+	verbosityRequest = 2 // Request and response metadata: URLs, retries, finish reasons, token usage, and validation steps
+	verbosityDetail  = 3 // Time budget, elapsed time, and raw response text
+)
+
+// Longest raw response text logged in verbose mode without --full-raw
+const rawTextLogLimit = 2000
+
+// Longest line accepted as a prompt in --repl mode
+const maxREPLLineBytes = 1024 * 1024
+
+// Locations used when --location is not set for models that are only served from one location.
+// Entries can be added or overridden with --model-locations.
+var modelDefaultLocations = map[string]string{
+	"gemini-3-pro-preview":       "global",
+	"gemini-3-pro-image-preview": "global",
+}
+
+// Deprecated models, matched as substrings of the model ID, and the model suggested instead. Entries
+// can be added, overridden, or removed with --deprecated-models.
+var deprecatedModelReplacements = map[string]string{
+	"gemini-1.0-pro":    "gemini-2.5-flash",
+	"gemini-1.5-pro":    "gemini-2.5-pro",
+	"gemini-1.5-flash":  "gemini-2.5-flash",
+	"gemini-pro":        "gemini-2.5-flash",
+	"gemini-pro-vision": "gemini-2.5-flash",
+}
+
 // File size limits
 const (
 	maxImageSizeBytes = 7 * 1024 * 1024  // 7 MB per image file (before base64 encoding)
 	maxTotalSizeBytes = 20 * 1024 * 1024 // ~20 MB total request size limit
+
+	defaultMaxResponseBytes = 64 * 1024 * 1024 // Largest API response read unless --max-response-bytes is set
+	defaultMaxAttachments   = 100              // Most attachments accepted unless --max-attachments is set
+	defaultMaxErrors        = 10               // Validation failures listed unless --max-errors is set
 )
 
 // CLI flags
 var (
-	systemInstruction     string
-	systemInstructionFile string
-	schema                string
-	schemaFile            string
-	prompt                string
-	promptFile            string
-	attachments           []string
-	outFile               string
-	projectFlag           string
-	locationFlag          string
-	modelFlag             string
-	timeout               int
-	verbose               bool
-	prettyPrint           bool
-	showVersion           bool
-	showHelp              bool
-	showURL               bool
-	showRequestBody       bool
+	systemInstruction         string
+	systemInstructionFile     string
+	systemInstructionEnv      string
+	systemInstructionTemplate string
+	templateVars              []string
+	schema                    string
+	schemaFiles               []string
+	schemaEnv                 string
+	schemaSelect              string
+	lenientSchemaJSON         bool
+	extractFirstJSONValue     bool
+	strictSchema              bool
+	acceptTruncated           bool
+	retryUnknownFinish        bool
+	acceptFinishReasons       string
+	requestID                 string
+	fullRaw                   bool
+	temperature               float64
+	topK                      int
+	seed                      int
+	deterministic             bool
+	schemaCacheSize           int
+	dumpEffectiveConfig       bool
+	transformCommand          string
+	preferIPv4                bool
+	failOnEmpty               bool
+	connectTimeout            int
+	authTimeout               int
+	maxResponseBytes          int64
+	strictContentType         bool
+	auditLog                  string
+	metricsFile               string
+	baselineFile              string
+	diffFile                  string
+	failOnDiff                bool
+	credentialsSource         string
+	credentialsFile           string
+	scopes                    []string
+	strictJSONNumber          bool
+	coerceIntegers            bool
+	applyDefaults             bool
+	degradeSchemaAfter        int
+	retryOnValidation         int
+	modelLocationsFile        string
+	deprecatedModelsFile      string
+	estimateCostOnly          bool
+	benchmark                 int
+	concurrency               int
+	benchmarkResults          bool
+	noCachePrompt             bool
+	priceFile                 string
+	genSchemaFile             string
+	prompt                    string
+	emitPropertyOrdering      bool
+	warnSchemaBytes           int
+	promptFiles               []string
+	promptFileSeparator       string
+	partsFile                 string
+	requestTemplate           string
+	promptEnv                 string
+	promptTemplate            string
+	promptDelimiter           string
+	pdfChunkPages             int
+	replMode                  bool
+	mergeStrategy             string
+	resultsFormat             string
+	attachments               []string
+	maxAttachments            int
+	attachmentsFirst          bool
+	requireAttachments        bool
+	dedupAttachments          bool
+	attachType                string
+	outFile                   string
+	projectFlag               string
+	quotaProjectFlag          string
+	locationFlag              string
+	modelFlag                 string
+	fallbackModel             string
+	timeout                   int
+	allowedModels             string
+	maxRetries                int
+	retryJitter               string
+	retrySeed                 uint64
+	verbose                   bool
+	verbosity                 int
+	verboseCount              countValue
+	quiet                     bool
+	failOnWarnings            bool
+	prettyPrint               bool
+	normalize                 bool
+	sortedOutput              bool
+	noSortKeys                bool
+	prettyStdout              bool
+	embedMetadata             bool
+	writeBOM                  bool
+	writeCRLF                 bool
+	trailingNewline           bool
+	showVersion               bool
+	statusLine                bool
+	showHelp                  bool
+	showURL                   bool
+	showRequestBody           bool
+	wrapBase64                string
+	emitRequestHash           bool
+	grounding                 bool
+	printGenSchema            bool
+	jsonSchemaToOpenAPI       bool
+	groundingFile             string
+	logprobs                  int
+	logprobsFile              string
+	errorsFile                string
+	validationExitCode        int
+	maxErrors                 int
+	logFile                   string
+	syslogEnabled             bool
+	syslogPriority            string
+	syslogTag                 string
+	syslogResults             bool
+	validatePointer           string
+	allowRemoteRefs           bool
+	useEmbeddedSchema         string
+	crossCheckDraft           string
+	minConfidence             float64
+	confidencePointer         string
 )
 
 func main() {
-	if err := run(); err != nil {
+	err := run()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	// The status line is always the last line written to STDERR
+	if statusLine {
+		writeStatusLine(err)
+	}
+	if err != nil {
 		os.Exit(getExitCode(err))
 	}
 }
@@ -72,6 +295,9 @@ func main() {
 func run() error {
 	defineFlags()
 	flag.Parse()
+	if err := selectCommand(); err != nil {
+		return auditConfigFailure(nil, err)
+	}
 
 	if showVersion {
 		fmt.Fprintf(os.Stderr, "prompt2json version %s\n", Version)
@@ -79,699 +305,4002 @@ func run() error {
 	}
 
 	if showHelp {
-		printHelp()
+		printCommandHelp()
 		return nil
 	}
+	if err := checkCommandFlags(); err != nil {
+		return auditConfigFailure(nil, err)
+	}
 
 	// Validate and load inputs
 	config, err := loadConfiguration()
 	if err != nil {
-		return err
+		return auditConfigFailure(config, recordFailure(config, stageConfig, err))
 	}
 
-	// Load attachments
-	attachmentParts, err := loadAttachments(config)
+	if dumpEffectiveConfig {
+		dump, err := json.MarshalIndent(effectiveConfig(config), "", "  ")
+		if err != nil {
+			return &inputError{fmt.Sprintf("failed to marshal effective configuration: %v", err)}
+		}
+		if err := writeOutput(config, string(dump)); err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+		return nil
+	}
+
+	// Warnings about the configuration fail the run before any request is made
+	if err := checkAdvisoryWarnings(config); err != nil {
+		return auditConfigFailure(config, recordFailure(config, stageConfig, err))
+	}
+
+	if config.Verbosity >= verbosityDetail && activeCommand.request {
+		logTimeBudget(config)
+	}
+	start := time.Now()
+	err = runCommand(config)
+	if err == nil {
+		err = checkAdvisoryWarnings(config)
+	}
+	if config.Verbosity >= verbosityDetail {
+		config.Log.Printf("Elapsed: %s\n", time.Since(start).Round(time.Millisecond))
+	}
 	if err != nil {
-		return err
+		// main prints the error to STDERR; the log file receives it here
+		config.Log.Record("Error: %v", err)
+	}
+	if config.AuditLog != "" {
+		if auditErr := appendAuditRecord(config, err); auditErr != nil {
+			if err != nil {
+				config.Log.Printf("Warning: %v\n", auditErr)
+				return err
+			}
+			return &inputError{auditErr.Error()}
+		}
+	}
+	if config.MetricsFile != "" {
+		if metricsErr := writeMetricsFile(config); metricsErr != nil {
+			if err != nil {
+				config.Log.Printf("Warning: %v\n", metricsErr)
+				return err
+			}
+			return &inputError{metricsErr.Error()}
+		}
 	}
+	return err
+}
 
-	// Build Gemini API request
-	requestBody, err := buildGeminiRequest(config, attachmentParts)
+// auditConfigFailure appends the --audit-log record of a run that failed before any request was
+// made and returns the original error; a failure to write the record is only a warning
+func auditConfigFailure(config *Config, err error) error {
+	if auditLog != "" {
+		if auditErr := appendConfigAuditRecord(config, err); auditErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", auditErr)
+		}
+	}
+	return err
+}
+
+// execute loads the attachments and processes the prompt (or prompts) of the loaded configuration
+func execute(config *Config) error {
+	// The conversion needs only the schema, so nothing else is loaded
+	if jsonSchemaToOpenAPI {
+		converted, warnings, err := convertToOpenAPISchema(config.Schema)
+		if err != nil {
+			return recordFailure(config, stageRequest, err)
+		}
+		for _, warning := range warnings {
+			warnAdvisory(config, warningSchemaConversion, "%s\n", warning)
+		}
+		output, err := formatJSON(config, converted)
+		if err != nil {
+			return recordFailure(config, stageRequest, &inputError{fmt.Sprintf("failed to format schema: %v", err)})
+		}
+		if err := writeOutput(config, output); err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+		return nil
+	}
+
+	// Load attachments
+	attachmentParts, err := loadAttachments(config)
 	if err != nil {
-		return err
+		return recordFailure(config, stageAttachments, err)
 	}
 
-	// Handle dry-run modes
-	if showURL {
-		url := buildGeminiURL(config)
-		if err := writeOutput(config, url); err != nil {
-			return err
+	if estimateCostOnly {
+		requests, err := plannedRequests(config, attachmentParts)
+		if err != nil {
+			return recordFailure(config, stageRequest, err)
+		}
+		estimate, err := estimateCost(config, requests)
+		if err != nil {
+			return recordFailure(config, stageAPI, err)
+		}
+		if err := writeOutput(config, estimate); err != nil {
+			return recordFailure(config, stageOutput, err)
 		}
 		return nil
 	}
 
-	if showRequestBody {
-		var formattedRequest string
-		if prettyPrint {
-			// Pretty-print the request body using json.Indent
-			var prettyBuf bytes.Buffer
-			if err := json.Indent(&prettyBuf, requestBody, "", "  "); err != nil {
-				return &inputError{fmt.Sprintf("failed to format request body: %v", err)}
+	// Handle dry-run modes
+	if emitRequestHash {
+		requests, err := plannedRequests(config, attachmentParts)
+		if err != nil {
+			return recordFailure(config, stageRequest, err)
+		}
+		hashes := make([]string, len(requests))
+		for i, request := range requests {
+			if hashes[i], err = requestHash(config.Model, request); err != nil {
+				return recordFailure(config, stageRequest, err)
 			}
-			formattedRequest = prettyBuf.String()
-		} else {
-			formattedRequest = string(requestBody)
 		}
-
-		if err := writeOutput(config, formattedRequest); err != nil {
-			return err
+		if err := writeOutput(config, strings.Join(hashes, "\n")); err != nil {
+			return recordFailure(config, stageOutput, err)
 		}
 		return nil
 	}
 
-	// Call Gemini API
-	responseJSON, err := callGeminiAPI(config, requestBody)
-	if err != nil {
-		return err
+	if showURL {
+		url := buildGeminiURL(config)
+		if err := writeOutput(config, url); err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+		return nil
 	}
 
-	// Validate and format the JSON response
-	formattedJSON, validationErr := validateAndFormatJSON(config, responseJSON)
+	// In REPL mode each line of STDIN is a prompt with its own result
+	if config.REPL {
+		return processREPL(config, attachmentParts)
+	}
 
-	// If validation failed, don't write to STDOUT
-	if validationErr != nil {
-		return validationErr
+	if config.Benchmark > 0 {
+		return runBenchmark(config, attachmentParts)
 	}
 
-	if config.Verbose {
-		if config.OutFile != "" {
-			fmt.Fprintf(os.Stderr, "Output to: %s\n", config.OutFile)
-		} else {
-			fmt.Fprintf(os.Stderr, "Output to: stdout\n")
+	if printGenSchema {
+		responseSchema, err := buildResponseSchema(config)
+		if err != nil {
+			return recordFailure(config, stageRequest, err)
 		}
+		output, err := formatJSON(config, responseSchema)
+		if err != nil {
+			return recordFailure(config, stageRequest, &inputError{fmt.Sprintf("failed to format schema: %v", err)})
+		}
+		if err := writeOutput(config, output); err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+		return nil
 	}
 
-	// Write output only when validation succeeds
-	if err := writeOutput(config, formattedJSON); err != nil {
-		return err
+	// A chunked PDF is processed one page range at a time and the results are merged
+	if len(config.PDFChunkParts) > 0 {
+		return processPDFChunks(config, attachmentParts)
 	}
 
-	return nil
-}
+	// Multiple prompts split from STDIN are processed in order against the same configuration
+	if len(config.Prompts) > 0 {
+		return processPrompts(config, attachmentParts)
+	}
 
-func defineFlags() {
-	flag.StringVar(&systemInstruction, "system-instruction", "", "System instruction (inline text)")
-	flag.StringVar(&systemInstructionFile, "system-instruction-file", "", "System instruction from file")
-	flag.StringVar(&schema, "schema", "", "JSON Schema (inline JSON)")
-	flag.StringVar(&schemaFile, "schema-file", "", "JSON Schema from file")
-	flag.StringVar(&prompt, "prompt", "", "Prompt text (inline)")
-	flag.StringVar(&promptFile, "prompt-file", "", "Prompt from file")
-	flag.Var((*stringArrayValue)(&attachments), "attach", "Attach file (repeatable)")
-	flag.StringVar(&outFile, "out", "", "Output file path (default: STDOUT)")
-	flag.StringVar(&projectFlag, "project", "", "GCP project ID")
-	flag.StringVar(&locationFlag, "location", "", "GCP location/region")
-	flag.StringVar(&modelFlag, "model", "", "Gemini model identifier")
-	flag.IntVar(&timeout, "timeout", 60, "HTTP request timeout in seconds (default: 60)")
-	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging to STDERR")
-	flag.BoolVar(&prettyPrint, "pretty-print", false, "Pretty-print JSON output")
-	flag.BoolVar(&showVersion, "version", false, "Show version")
-	flag.BoolVar(&showHelp, "help", false, "Show help")
-	flag.BoolVar(&showURL, "show-url", false, "Show the API URL that would be called (dry-run mode)")
-	flag.BoolVar(&showRequestBody, "show-request-body", false, "Show the JSON request body that would be sent (dry-run mode)")
-}
+	output, stage, err := processPrompt(config, attachmentParts)
+	if err != nil {
+		return recordFailure(config, stage, err)
+	}
 
-type stringArrayValue []string
+	if err := writeResult(config, output); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
 
-func (s *stringArrayValue) String() string {
-	return strings.Join(*s, ",")
-}
+	if config.BaselineFile != "" {
+		if err := compareWithBaseline(config, output); err != nil {
+			return recordFailure(config, stageValidation, err)
+		}
+	}
 
-func (s *stringArrayValue) Set(value string) error {
-	*s = append(*s, value)
 	return nil
 }
 
-func printHelp() {
-	fmt.Fprintf(os.Stderr, `prompt2json - Turn prompts into schema-validated JSON using Vertex AI (Gemini)
-
-Usage:
-  prompt2json [OPTIONS]
-
-Required:
-  --system-instruction TEXT | --system-instruction-file PATH
-  --schema JSON             | --schema-file PATH
-  --project ID
-  --location REGION
-  --model NAME
+// processPrompt builds and sends the request for config.Prompt and returns the validated and
+// formatted output (or the request body with --show-request-body). On failure the stage that
+// failed is returned along with the error.
+func processPrompt(config *Config, attachmentParts []interface{}) (string, string, error) {
+	output, stage, err := generateResult(config, attachmentParts)
+	if err != nil || showRequestBody {
+		return output, stage, err
+	}
 
-Input:
-  --prompt TEXT              Prompt text (default: read from stdin)
-  --prompt-file PATH         Read prompt from file (mutually exclusive with --prompt)
-  --attach PATH              Attach file (repeatable): png, jpg/jpeg, webp, pdf
+	if config.Transform != "" {
+		output, err = applyTransform(config, output)
+		if err != nil {
+			return "", stageTransform, err
+		}
+	}
 
-Output:
-  --out PATH                 Write JSON to file (default: stdout)
-  --pretty-print             Pretty-print JSON output (default: minified)
+	if !config.EmbedMetadata {
+		return output, "", nil
+	}
+	output, err = embedResultMetadata(config, output)
+	if err != nil {
+		return "", stageOutput, err
+	}
+	return output, "", nil
+}
 
-Dry-run (debug):
-  --show-url                 Output the API URL without making the request
-  --show-request-body        Output the JSON request body without making the request
+// generateResult builds and sends the request and returns the validated and formatted response,
+// or the request body with --show-request-body
+func generateResult(config *Config, attachmentParts []interface{}) (string, string, error) {
+	// Build Gemini API request
+	requestBody, err := buildGeminiRequest(config, attachmentParts)
+	if err != nil {
+		return "", stageRequest, err
+	}
 
-Misc:
-  --timeout SECONDS          HTTP request timeout in seconds (default: 60)
-  --verbose                  Log diagnostics to stderr
-  --version                  Print version and exit
-  --help                     Print help and exit
+	if showRequestBody {
+		body := string(requestBody)
+		if prettyPrint {
+			// Pretty-print the request body using json.Indent
+			var prettyBuf bytes.Buffer
+			if err := json.Indent(&prettyBuf, requestBody, "", "  "); err != nil {
+				return "", stageRequest, &inputError{fmt.Sprintf("failed to format request body: %v", err)}
+			}
+			body = prettyBuf.String()
+		}
+		if config.WrapBase64 != "" {
+			body = displayBase64(body, config.WrapBase64)
+		}
+		return body, "", nil
+	}
 
-Environment (used if option not set):
-  --project   GOOGLE_CLOUD_PROJECT, CLOUDSDK_CORE_PROJECT
-  --location  GOOGLE_CLOUD_LOCATION, GOOGLE_CLOUD_REGION, CLOUDSDK_COMPUTE_REGION
+	for failures := 0; ; {
+		// Call Gemini API
+		responseJSON, err := callGeminiWithFailover(config, requestBody)
+		if err != nil {
+			return "", stageAPI, err
+		}
 
-Exit status: 0 success, 2 usage, 3 input, 4 validation/response, 5 API/auth
+		// Validate and format the JSON response; on failure nothing is written to STDOUT
+		formattedJSON, err := validateAndFormatJSON(config, responseJSON)
+		if err == nil {
+			if config.RetryOnValidation > 0 {
+				config.Log.Printf("Validation retry: attempt %d of %d passed\n", failures+1, config.RetryOnValidation+1)
+			}
+			return formattedJSON, "", nil
+		}
+		_, isValidation := err.(*validationError)
 
-JSON Processing:
-  - LLM responses are validated as parsable JSON
-  - Valid JSON is validated against the provided schema
-  - JSON is minified by default; use --pretty-print for human-readable output
-  - Output is only written to STDOUT when validation succeeds
-  - Validation errors are written to STDERR
+		// With --retry-on-validation, the identical request is re-issued in the hope that the
+		// nondeterministic model produces a valid response
+		if isValidation && config.RetryOnValidation > 0 {
+			failures++
+			if failures > config.RetryOnValidation {
+				config.Log.Printf("Validation retry: attempt %d of %d failed; giving up\n", failures, config.RetryOnValidation+1)
+				return "", stageValidation, err
+			}
+			config.Log.Printf("Validation retry: attempt %d of %d failed (%v); re-issuing the request\n", failures, config.RetryOnValidation+1, err)
+			continue
+		}
 
-Example:
-  echo "this is great" | prompt2json \
-    --system-instruction "Classify sentiment" \
-    --schema '{"type":"object","properties":{"sentiment":{"type":"string","enum":["POSITIVE","NEGATIVE","NEUTRAL"]},"confidence":{"type":"integer","minimum":0,"maximum":100}},"required":["sentiment","confidence"]}' \
-    --project example-project \
-    --location us-central1 \
-    --model gemini-2.5-flash
-`)
-}
+		if !isValidation || config.DegradeAfter == 0 || config.Degraded {
+			return "", stageValidation, err
+		}
 
-type Config struct {
-	SystemInstruction    string
-	SystemInstructionSrc string // Source: "flag" or file path
-	Schema               map[string]interface{}
-	SchemaSrc            string // Source: "flag" or file path
-	CompiledSchema       *jsonschema.Schema
-	Prompt               string
-	PromptSrc            string // Source: "stdin", "flag", or file path
-	Project              string
-	Location             string
-	Model                string
-	Timeout              int
-	OutFile              string
-	Verbose              bool
-	PrettyPrint          bool
+		// With --degrade-schema, validation failures are retried and the last attempt switches
+		// config to the degraded schema, which also applies to a --transform and the metadata
+		failures++
+		if failures < config.DegradeAfter {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Validation failed (%d of %d before degrading); retrying\n", failures, config.DegradeAfter)
+			}
+			continue
+		}
+		config.Log.Printf("Warning: validation failed %d times (%v); retrying with the degraded schema\n", failures, err)
+		config.Degraded = true
+		config.CompiledSchemas = []compiledSchema{config.DegradedSchema}
+		requestBody, err = buildGeminiRequest(config, attachmentParts)
+		if err != nil {
+			return "", stageRequest, err
+		}
+	}
 }
 
-func loadConfiguration() (*Config, error) {
-	config := &Config{
-		Verbose:     verbose,
-		OutFile:     outFile,
-		PrettyPrint: prettyPrint,
+// applyTransform pipes the validated JSON through the --transform command and validates the
+// command's output against the schema again, so a transform can never produce invalid output
+func applyTransform(config *Config, validatedJSON string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", config.Transform)
+	} else {
+		cmd = exec.Command("sh", "-c", config.Transform)
+	}
+	cmd.Stdin = strings.NewReader(validatedJSON)
+	cmd.Stderr = os.Stderr
+	transformed, err := cmd.Output()
+	if err != nil {
+		return "", &validationError{fmt.Sprintf("transform command failed: %v", err)}
 	}
 
-	// Load system instruction
-	if systemInstruction != "" && systemInstructionFile != "" {
-		return nil, &cliError{"cannot specify both --system-instruction and --system-instruction-file"}
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Transform: %d bytes in, %d bytes out\n", len(validatedJSON), len(transformed))
 	}
-	if systemInstruction == "" && systemInstructionFile == "" {
-		return nil, &cliError{"must specify either --system-instruction or --system-instruction-file"}
+
+	formattedJSON, err := validateAndFormatJSON(config, string(transformed))
+	if err != nil {
+		if validationErr, ok := err.(*validationError); ok {
+			validationErr.message = "transform output failed validation: " + validationErr.message
+		}
+		return "", err
 	}
+	return formattedJSON, nil
+}
 
-	if systemInstruction != "" {
-		config.SystemInstruction = strings.TrimSpace(systemInstruction)
-		config.SystemInstructionSrc = "flag"
-	} else {
-		content, err := os.ReadFile(systemInstructionFile)
+// processPDFChunks runs the prompt once per page range of the chunked PDF attachment and merges
+// the validated results with the configured merge strategy. The first failing chunk stops
+// processing, and the merged result is validated against the schema again before it is written.
+func processPDFChunks(config *Config, attachmentParts []interface{}) error {
+	var requests []string
+	var results []interface{}
+	degraded := false
+	for i, chunkPart := range config.PDFChunkParts {
+		chunkConfig := *config
+		chunkConfig.RequestID = fmt.Sprintf("%s-%d", config.RequestID, i+1)
+		chunkConfig.Log = config.Log.withPrefix(chunkConfig.RequestID)
+
+		// The chunk takes the place of the PDF among the attachments
+		parts := make([]interface{}, 0, len(attachmentParts)+1)
+		parts = append(parts, attachmentParts[:config.PDFChunkIndex]...)
+		parts = append(parts, chunkPart)
+		parts = append(parts, attachmentParts[config.PDFChunkIndex:]...)
+
+		output, stage, err := generateResult(&chunkConfig, parts)
 		if err != nil {
-			return nil, &inputError{fmt.Sprintf("failed to read system instruction file: %v", err)}
+			return recordFailure(&chunkConfig, stage, err)
+		}
+		if showRequestBody {
+			requests = append(requests, output)
+			continue
 		}
-		config.SystemInstruction = strings.TrimSpace(string(content))
-		config.SystemInstructionSrc = systemInstructionFile
-	}
 
-	if config.SystemInstruction == "" {
-		return nil, &inputError{"system instruction cannot be empty"}
+		var result interface{}
+		decoder := json.NewDecoder(strings.NewReader(output))
+		decoder.UseNumber()
+		if err := decoder.Decode(&result); err != nil {
+			return recordFailure(&chunkConfig, stageValidation, &validationError{fmt.Sprintf("failed to decode chunk result: %v", err)})
+		}
+		results = append(results, result)
+		degraded = degraded || chunkConfig.Degraded
 	}
 
-	if verbose {
-		if config.SystemInstructionSrc == "flag" {
-			fmt.Fprintf(os.Stderr, "System instruction: %d bytes (from flag)\n", len(config.SystemInstruction))
-		} else {
-			fmt.Fprintf(os.Stderr, "System instruction: %d bytes (from %s)\n", len(config.SystemInstruction), config.SystemInstructionSrc)
+	if showRequestBody {
+		if err := writeOutput(config, strings.Join(requests, "\n")); err != nil {
+			return recordFailure(config, stageOutput, err)
 		}
+		return nil
 	}
 
-	// Load schema
-	if schema != "" && schemaFile != "" {
-		return nil, &cliError{"cannot specify both --schema and --schema-file"}
+	merged, err := mergeChunkResults(results, config.MergeStrategy)
+	if err != nil {
+		return recordFailure(config, stageValidation, err)
+	}
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return recordFailure(config, stageValidation, &validationError{fmt.Sprintf("failed to encode merged result: %v", err)})
 	}
-	if schema == "" && schemaFile == "" {
-		return nil, &cliError{"must specify either --schema or --schema-file"}
+	if config.Verbosity >= verbosityConfig {
+		config.Log.Printf("Merged %d chunk results (%s)\n", len(results), config.MergeStrategy)
 	}
 
-	var schemaBytes []byte
-	if schema != "" {
-		schemaBytes = []byte(schema)
-		config.SchemaSrc = "flag"
-	} else {
-		content, err := os.ReadFile(schemaFile)
+	// A merged result that includes a degraded chunk can only pass the degraded schema
+	if degraded {
+		config.Degraded = true
+		config.CompiledSchemas = []compiledSchema{config.DegradedSchema}
+	}
+
+	// Each chunk already passed the confidence check, which does not apply to the merged result
+	mergedConfig := *config
+	mergedConfig.MinConfidence = nil
+	formattedJSON, err := validateAndFormatJSON(&mergedConfig, string(mergedJSON))
+	if err != nil {
+		return recordFailure(config, stageValidation, err)
+	}
+
+	if config.Transform != "" {
+		formattedJSON, err = applyTransform(&mergedConfig, formattedJSON)
 		if err != nil {
-			return nil, &inputError{fmt.Sprintf("failed to read schema file: %v", err)}
+			return recordFailure(config, stageTransform, err)
+		}
+	}
+
+	if config.EmbedMetadata {
+		formattedJSON, err = embedResultMetadata(config, formattedJSON)
+		if err != nil {
+			return recordFailure(config, stageOutput, err)
+		}
+	}
+
+	if err := writeResult(config, formattedJSON); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	if config.BaselineFile != "" {
+		if err := compareWithBaseline(config, formattedJSON); err != nil {
+			return recordFailure(config, stageValidation, err)
+		}
+	}
+	return nil
+}
+
+// processPrompts processes each prompt split from STDIN in input order and writes the successful
+// results as NDJSON or a JSON array. Without --errors-file the first failure stops processing and
+// nothing is written; with it, failures are recorded, the remaining prompts are still processed,
+// and the first failure determines the exit status.
+func processPrompts(config *Config, attachmentParts []interface{}) error {
+	var results []string
+	var firstErr error
+	for i, itemPrompt := range config.Prompts {
+		itemConfig := *config
+		itemConfig.Prompt = itemPrompt
+		itemConfig.Prompts = nil
+		itemConfig.PromptSrc = fmt.Sprintf("%s#%d", config.PromptSrc, i+1)
+		itemConfig.RequestID = fmt.Sprintf("%s-%d", config.RequestID, i+1)
+		itemConfig.Log = config.Log.withPrefix(itemConfig.RequestID)
+
+		output, stage, err := processPrompt(&itemConfig, attachmentParts)
+		if err != nil {
+			recordFailure(&itemConfig, stage, err)
+			if errorsFile == "" {
+				itemConfig.Log.Printf("Failed; stopping without writing results\n")
+				return err
+			}
+			itemConfig.Log.Printf("Error: %v\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		results = append(results, output)
+	}
+
+	if config.Verbosity >= verbosityConfig {
+		config.Log.Printf("Prompts: %d succeeded, %d failed\n", len(results), len(config.Prompts)-len(results))
+	}
+
+	var combined string
+	if config.ResultsFormat == resultsFormatArray {
+		combined = "[" + strings.Join(results, ",") + "]"
+		if config.PrettyPrint {
+			var prettyBuf bytes.Buffer
+			if err := json.Indent(&prettyBuf, []byte(combined), "", "  "); err != nil {
+				return recordFailure(config, stageOutput, &validationError{fmt.Sprintf("failed to format results: %v", err)})
+			}
+			combined = prettyBuf.String()
+		}
+	} else if len(results) > 0 {
+		combined = strings.Join(results, "\n")
+	} else {
+		return firstErr
+	}
+
+	if err := writeResult(config, combined); err != nil {
+		return recordFailure(config, stageOutput, err)
+	}
+	return firstErr
+}
+
+// processREPL reads prompts from STDIN one line at a time and writes the result of each as soon as
+// it is validated, reusing one HTTP client and token source until EOF. A failed prompt is reported
+// on STDERR and the loop continues; the first failure determines the exit status.
+func processREPL(config *Config, attachmentParts []interface{}) error {
+	if !showRequestBody {
+		session, err := newAPISession(config)
+		if err != nil {
+			return recordFailure(config, stageAPI, err)
+		}
+		config.Session = session
+	}
+
+	// Only show an input prompt when a person is typing
+	interactive := false
+	if info, err := os.Stdin.Stat(); err == nil {
+		interactive = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxREPLLineBytes)
+	var firstErr error
+	succeeded := 0
+	for {
+		if interactive {
+			fmt.Fprint(os.Stderr, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		config.Prompts = append(config.Prompts, line)
+
+		itemConfig := *config
+		itemConfig.Prompt = line
+		itemConfig.Prompts = nil
+		itemConfig.PromptSrc = fmt.Sprintf("%s#%d", config.PromptSrc, len(config.Prompts))
+		itemConfig.RequestID = fmt.Sprintf("%s-%d", config.RequestID, len(config.Prompts))
+		itemConfig.Log = config.Log.withPrefix(itemConfig.RequestID)
+
+		output, stage, err := processPrompt(&itemConfig, attachmentParts)
+		if err == nil {
+			stage = stageOutput
+			err = writeResult(&itemConfig, output)
+		}
+		if err != nil {
+			recordFailure(&itemConfig, stage, err)
+			itemConfig.Log.Printf("Error: %v\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		succeeded++
+	}
+	if interactive {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err := scanner.Err(); err != nil {
+		return recordFailure(config, stageConfig, &inputError{fmt.Sprintf("failed to read from STDIN: %v", err)})
+	}
+
+	if config.Verbosity >= verbosityConfig {
+		config.Log.Printf("Prompts: %d succeeded, %d failed\n", succeeded, len(config.Prompts)-succeeded)
+	}
+	return firstErr
+}
+
+// writeResult writes the final output, plus the pretty-printed STDOUT copy when requested
+func writeResult(config *Config, output string) error {
+	if config.Verbosity >= verbosityConfig {
+		if config.OutFile != "" {
+			config.Log.Printf("Output to: %s\n", config.OutFile)
+		} else {
+			config.Log.Printf("Output to: stdout\n")
+		}
+	}
+
+	if err := writeOutput(config, output); err != nil {
+		return err
+	}
+	if config.Syslog != nil {
+		if _, err := io.WriteString(config.Syslog, output); err != nil {
+			return &inputError{fmt.Sprintf("failed to write result to the system log: %v", err)}
+		}
+	}
+
+	// Print a pretty-printed copy for review while the file keeps the configured format
+	if config.PrettyStdout {
+		var prettyBuf bytes.Buffer
+		if err := json.Indent(&prettyBuf, []byte(output), "", "  "); err != nil {
+			return &validationError{fmt.Sprintf("failed to format output: %v", err)}
+		}
+		fmt.Println(prettyBuf.String())
+	}
+
+	return nil
+}
+
+// recordFailure appends an error record for a failed stage to the --errors-file (when set) and
+// returns the original error. The record id is the prompt source ("stdin", "flag", "template", or
+// the prompt file path) so failed inputs can be identified and retried.
+func recordFailure(config *Config, stage string, err error) error {
+	if errorsFile == "" {
+		return err
+	}
+
+	var id string
+	switch {
+	case config != nil:
+		id = config.PromptSrc
+	case len(promptFiles) > 0:
+		id = strings.Join(promptFiles, ",")
+	case promptEnv != "":
+		id = "env:" + promptEnv
+	case prompt != "":
+		id = "flag"
+	case promptTemplate != "":
+		id = "template"
+	default:
+		id = "stdin"
+	}
+	record, marshalErr := json.Marshal(struct {
+		ID       string `json:"id"`
+		Stage    string `json:"stage"`
+		Message  string `json:"message"`
+		ExitCode int    `json:"exitCode"`
+	}{id, stage, err.Error(), getExitCode(err)})
+	if marshalErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to encode error record: %v\n", marshalErr)
+		return err
+	}
+
+	file, openErr := os.OpenFile(errorsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if openErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open errors file: %v\n", openErr)
+		return err
+	}
+	defer file.Close()
+	if _, writeErr := file.Write(append(record, '\n')); writeErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write errors file: %v\n", writeErr)
+	}
+	return err
+}
+
+func defineFlags() {
+	flag.StringVar(&systemInstruction, "system-instruction", "", "System instruction (inline text)")
+	flag.StringVar(&systemInstructionFile, "system-instruction-file", "", "System instruction from file")
+	flag.StringVar(&systemInstructionEnv, "system-instruction-env", "", "System instruction from the named environment variable")
+	flag.StringVar(&systemInstructionTemplate, "system-instruction-template", "", "System instruction from a template file with ${NAME} variables")
+	flag.Var((*stringArrayValue)(&templateVars), "set", "Template variable NAME=VALUE for --system-instruction-template (repeatable)")
+	flag.StringVar(&schema, "schema", "", "JSON Schema (inline JSON, or - to read it from STDIN)")
+	flag.Var((*stringArrayValue)(&schemaFiles), "schema-file", "JSON Schema from file (repeatable with --schema-select)")
+	flag.StringVar(&schemaEnv, "schema-env", "", "JSON Schema from the named environment variable")
+	flag.IntVar(&schemaCacheSize, "schema-cache", 0, "Cache up to N compiled schemas by content hash so identical schemas compile once")
+	flag.BoolVar(&lenientSchemaJSON, "lenient-schema-json", false, "Allow comments and trailing commas in schemas")
+	flag.BoolVar(&extractFirstJSONValue, "extract-first-json", false, "Validate the first balanced JSON object or array in the response, ignoring text around it")
+	flag.BoolVar(&strictSchema, "strict-schema", false, "Check that every $ref in the schemas resolves before making the request")
+	flag.StringVar(&genSchemaFile, "gen-schema-file", "", "JSON Schema sent to the API instead of the validation schema")
+	flag.BoolVar(&emitPropertyOrdering, "emit-property-ordering", false, "Add propertyOrdering to the sent schema following the declaration order of properties")
+	flag.IntVar(&warnSchemaBytes, "warn-schema-bytes", 0, "Warn when the schema sent to the API exceeds this many bytes (default: 0, off)")
+	flag.StringVar(&schemaSelect, "schema-select", "", "Name ($id or file name) of the schema to use when multiple --schema-file are given")
+	flag.StringVar(&prompt, "prompt", "", "Prompt text (inline)")
+	flag.Var((*stringArrayValue)(&promptFiles), "prompt-file", "Prompt from file (repeatable; files are joined in order)")
+	flag.StringVar(&promptFileSeparator, "prompt-file-separator", `\n\n`, "Separator placed between repeated --prompt-file contents (escapes like \\n)")
+	flag.StringVar(&partsFile, "parts-file", "", "Read the user turn from a JSON array of ordered text and file parts")
+	flag.StringVar(&requestTemplate, "request-template", "", "Partial generateContent request JSON that the request is built on")
+	flag.StringVar(&promptEnv, "prompt-env", "", "Prompt from the named environment variable")
+	flag.StringVar(&promptTemplate, "prompt-template", "", "Go text/template rendered with the JSON object read from STDIN to produce the prompt")
+	flag.BoolVar(&replMode, "repl", false, "Read prompts from STDIN one line at a time and print a result for each until EOF")
+	flag.StringVar(&promptDelimiter, "prompt-delimiter", "", "Split STDIN into multiple prompts on this delimiter (escapes such as \\n and \\0 are interpreted)")
+	flag.StringVar(&resultsFormat, "results-format", resultsFormatNDJSON, "Format for the results of multiple prompts: ndjson or array")
+	flag.Var((*stringArrayValue)(&attachments), "attach", "Attach file (repeatable)")
+	flag.IntVar(&maxAttachments, "max-attachments", defaultMaxAttachments, "Most attachments accepted before failing (default: 100)")
+	flag.BoolVar(&attachmentsFirst, "attachments-first", false, "Place the attachments before the prompt text in the request")
+	flag.BoolVar(&requireAttachments, "require-attachments", false, "Fail when no attachment is given instead of sending a text-only request")
+	flag.BoolVar(&dedupAttachments, "dedup-attachments", false, "Send attachments with identical content only once")
+	flag.IntVar(&pdfChunkPages, "pdf-chunk-pages", 0, "Split the PDF attachment into chunks of N pages and run the prompt per chunk")
+	flag.StringVar(&mergeStrategy, "merge-strategy", mergeStrategyConcat, "How chunk results are merged: concat (arrays) or merge (objects)")
+	flag.StringVar(&attachType, "attach-type", "", "Attachment type when reading the attachment from STDIN with --attach -")
+	flag.StringVar(&outFile, "out", "", "Output file path (default: STDOUT)")
+	flag.StringVar(&projectFlag, "project", "", "GCP project ID")
+	flag.StringVar(&quotaProjectFlag, "quota-project", "", "GCP project billed for quota, sent as the X-Goog-User-Project header")
+	flag.StringVar(&locationFlag, "location", "", "GCP location/region (comma-separated list to fail over between locations)")
+	flag.StringVar(&modelFlag, "model", "", "Gemini model identifier")
+	flag.StringVar(&deprecatedModelsFile, "deprecated-models", "", "JSON file mapping deprecated model substrings to suggested replacements")
+	flag.StringVar(&modelLocationsFile, "model-locations", "", "JSON file mapping model names to the location used when --location is not set")
+	flag.StringVar(&allowedModels, "allowed-models", "", "Comma-separated list of the only model identifiers that may be used")
+	flag.StringVar(&fallbackModel, "model-fallback-on-429", "", "Model to retry with when the primary model is quota-throttled (HTTP 429)")
+	flag.StringVar(&requestID, "request-id", "", "Request ID sent as the X-Request-Id header and included in diagnostics (default: random UUID)")
+	flag.Float64Var(&temperature, "temperature", 0, "Sampling temperature (0-2)")
+	flag.IntVar(&topK, "top-k", 0, "Sample from the K most likely tokens")
+	flag.IntVar(&seed, "seed", 0, "Sampling seed")
+	flag.BoolVar(&deterministic, "deterministic", false, "Preset for reproducible output: temperature 0, top-k 1, seed 0, one candidate")
+	flag.BoolVar(&preferIPv4, "prefer-ipv4", false, "Connect over IPv4 first, falling back to IPv6")
+	flag.IntVar(&timeout, "timeout", 60, "HTTP request timeout in seconds (default: 60)")
+	flag.Var((*stringArrayValue)(&scopes), "scope", "OAuth scope of the access token (repeatable; default: cloud-platform)")
+	flag.StringVar(&credentialsSource, "credentials-source", credentialsSourceADC, "Where the access token comes from: adc, metadata, or file (default: adc)")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "Service account or external account JSON file used with --credentials-source file")
+	flag.Int64Var(&maxResponseBytes, "max-response-bytes", defaultMaxResponseBytes, "Largest API response body read before failing (default: 64 MiB)")
+	flag.BoolVar(&strictContentType, "strict-content-type", false, "Fail when a successful API response does not have a JSON Content-Type")
+	flag.IntVar(&connectTimeout, "connect-timeout", 0, "Timeout in seconds for the TCP connection and TLS handshake (default: 30 and 10)")
+	flag.IntVar(&authTimeout, "auth-timeout", 0, "Timeout in seconds for obtaining the access token (default: --timeout)")
+	flag.IntVar(&maxRetries, "max-retries", 0, "Retries for transient API failures (default: 0)")
+	flag.StringVar(&retryJitter, "retry-jitter", retryJitterNone, "Randomization of the retry backoff: none, full, or equal (default: none)")
+	flag.Uint64Var(&retrySeed, "retry-seed", 0, "Seed of the --retry-jitter random source, for reproducible retry timing")
+	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging to STDERR (same as --verbosity 3)")
+	flag.IntVar(&verbosity, "verbosity", 0, "Level of diagnostics logged to STDERR, from 0 (none) to 3 (all)")
+	flag.Var(&verboseCount, "v", "Raise the verbosity by one level (repeatable)")
+	flag.BoolVar(&quiet, "quiet", false, "Suppress advisory warnings on STDERR")
+	flag.BoolVar(&failOnWarnings, "fail-on-warnings", false, "Exit with status 10 when any advisory warning fires")
+	flag.BoolVar(&fullRaw, "full-raw", false, "Log the full raw response text in verbose mode instead of the first 2000 bytes")
+	flag.BoolVar(&prettyPrint, "pretty-print", false, "Pretty-print JSON output")
+	flag.StringVar(&transformCommand, "transform", "", "Shell command that transforms the validated JSON (STDIN to STDOUT); the result is validated again")
+	flag.BoolVar(&embedMetadata, "embed-metadata", false, "Wrap the result as {result, meta} with provenance metadata")
+	flag.BoolVar(&prettyStdout, "pretty-stdout", false, "Also print a pretty-printed copy to STDOUT when writing to --out")
+	flag.BoolVar(&normalize, "normalize", false, "Canonicalize JSON output (RFC 8785)")
+	flag.BoolVar(&sortedOutput, "sorted", false, "Serialize JSON output in a fixed, documented form with sorted keys and numbers as returned")
+	flag.BoolVar(&noSortKeys, "no-sort-keys", false, "Keep object keys in the order of the response instead of sorting them")
+	flag.BoolVar(&writeBOM, "bom", false, "Prefix output with a UTF-8 byte order mark")
+	flag.BoolVar(&writeCRLF, "crlf", false, "Use CRLF line endings in output")
+	flag.BoolVar(&trailingNewline, "trailing-newline", true, "End the output with a newline, on STDOUT and in --out files alike")
+	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.BoolVar(&statusLine, "status-line", false, "End STDERR with a machine-readable p2j-result line")
+	flag.BoolVar(&showHelp, "help", false, "Show help")
+	flag.BoolVar(&showURL, "show-url", false, "Show the API URL that would be called (dry-run mode)")
+	flag.BoolVar(&showURL, "print-url", false, "Alias for --show-url")
+	flag.BoolVar(&dumpEffectiveConfig, "dump-effective-config", false, "Print the resolved configuration as JSON and exit")
+	flag.BoolVar(&estimateCostOnly, "estimate-cost", false, "Count the prompt tokens and print the estimated prompt cost without generating")
+	flag.StringVar(&priceFile, "price-file", "", "JSON file of model names to USD prices per 1,000 prompt tokens for --estimate-cost")
+	flag.IntVar(&benchmark, "benchmark", 0, "Send the request N times and log latency percentiles and the success rate")
+	flag.IntVar(&concurrency, "concurrency", 1, "Benchmark requests in flight at once (default: 1)")
+	flag.BoolVar(&benchmarkResults, "benchmark-results", false, "Write the result of each successful benchmark request as NDJSON")
+	flag.BoolVar(&noCachePrompt, "no-cache-prompt", false, "End each request with a unique nonce so context caching and deduplication cannot serve it")
+	flag.BoolVar(&showRequestBody, "show-request-body", false, "Show the JSON request body that would be sent (dry-run mode)")
+	flag.StringVar(&wrapBase64, "wrap-base64", "", "With --show-request-body, wrap or truncate base64 attachment data for reading: wrap or truncate")
+	flag.BoolVar(&emitRequestHash, "emit-request-hash", false, "Show a stable SHA-256 of the model and request that would be sent (dry-run mode)")
+	flag.BoolVar(&printGenSchema, "print-gen-schema", false, "Show the schema that would be sent as responseJsonSchema (dry-run mode)")
+	flag.BoolVar(&jsonSchemaToOpenAPI, "json-schema-to-openapi", false, "Show the schema converted to the OpenAPI subset of responseSchema (dry-run mode)")
+	flag.BoolVar(&grounding, "grounding", false, "Enable grounding with Google Search")
+	flag.StringVar(&groundingFile, "grounding-file", "", "Write grounding metadata to file (requires --grounding)")
+	flag.IntVar(&logprobs, "logprobs", 0, "Request log probabilities with the top N candidate tokens per step (1-20)")
+	flag.StringVar(&logprobsFile, "logprobs-file", "", "Write the returned log probabilities to file (requires --logprobs)")
+	flag.BoolVar(&allowRemoteRefs, "allow-remote-refs", false, "Allow schema $ref to be resolved over HTTP(S)")
+	flag.StringVar(&useEmbeddedSchema, "use-embedded-schema", "", "Validate against the schema URL in the response's $schema: also or instead of the provided schemas")
+	flag.StringVar(&crossCheckDraft, "validate-only-against-draft", "", "Also validate each response under this JSON Schema draft and report any difference (diagnostic only)")
+	flag.StringVar(&validatePointer, "validate-pointer", "", "Validate only the value at this JSON Pointer against the schema")
+	flag.Float64Var(&minConfidence, "min-confidence", 0, "Fail when the confidence value in the response is below this threshold")
+	flag.BoolVar(&strictJSONNumber, "strict-json-number", false, "Keep numbers exactly as written and require integer-typed values to be integer literals")
+	flag.BoolVar(&coerceIntegers, "coerce-integers", false, "With --strict-json-number, rewrite integral values such as 5.0 as integers instead of failing")
+	flag.BoolVar(&applyDefaults, "apply-defaults", false, "Fill absent properties of the validated result with the schema's default values")
+	flag.BoolVar(&failOnEmpty, "fail-on-empty-object", false, "Treat an empty top-level object or array as a validation failure")
+	flag.IntVar(&retryOnValidation, "retry-on-validation", 0, "Re-issue the identical request up to N times when the response fails validation")
+	flag.IntVar(&degradeSchemaAfter, "degrade-schema", 0, "After N validation failures, retry once with a simplified schema and mark the result as degraded")
+	flag.StringVar(&acceptFinishReasons, "accept-finish-reasons", "", "Comma-separated finish reasons besides STOP whose responses are validated instead of rejected")
+	flag.BoolVar(&acceptTruncated, "accept-truncated", false, "Accept a response truncated at the output token limit if it still passes validation")
+	flag.BoolVar(&retryUnknownFinish, "retry-unknown-finish", false, "Retry a response whose finish reason is not recognized, like a transient API failure")
+	flag.StringVar(&confidencePointer, "confidence-pointer", "/confidence", "JSON Pointer to the confidence value checked by --min-confidence")
+	flag.IntVar(&validationExitCode, "validation-exit-code", exitValidationError, "Exit status for validation failures (default: 4)")
+	flag.IntVar(&maxErrors, "max-errors", defaultMaxErrors, "Most distinct schema validation failures listed per schema (default: 10)")
+	flag.StringVar(&auditLog, "audit-log", "", "Append a JSON audit record (metadata and hashes only) for each invocation to file")
+	flag.StringVar(&metricsFile, "metrics-file", "", "Write Prometheus text-format metrics of the run to file")
+	flag.StringVar(&baselineFile, "baseline-file", "", "Compare the result with a previous result and report the differences")
+	flag.StringVar(&diffFile, "diff-file", "", "Write the --baseline-file differences to file instead of STDERR")
+	flag.BoolVar(&failOnDiff, "fail-on-diff", false, "Exit with status 9 when the result differs from --baseline-file")
+	flag.StringVar(&logFile, "log-file", "", "Append every diagnostic to file as a JSON record per line, in addition to STDERR")
+	flag.BoolVar(&syslogEnabled, "syslog", false, "Also write diagnostics to the system log (Unix)")
+	flag.StringVar(&syslogPriority, "syslog-priority", "user.info", "Priority of system log entries as [facility.]severity")
+	flag.StringVar(&syslogTag, "syslog-tag", "prompt2json", "Tag of system log entries")
+	flag.BoolVar(&syslogResults, "syslog-results", false, "With --syslog, also write each result to the system log")
+	flag.StringVar(&errorsFile, "errors-file", "", "Append a JSON error record for each failure to file (NDJSON)")
+}
+
+// countValue is a boolean flag that counts how many times it is given, such as -v -v
+type countValue int
+
+func (c *countValue) String() string {
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countValue) Set(value string) error {
+	set, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if set {
+		*c++
+	}
+	return nil
+}
+
+func (c *countValue) IsBoolFlag() bool {
+	return true
+}
+
+type stringArrayValue []string
+
+func (s *stringArrayValue) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringArrayValue) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func printHelp() {
+	fmt.Fprintf(os.Stderr, `prompt2json - Turn prompts into schema-validated JSON using Vertex AI (Gemini)
+
+Usage:
+  prompt2json [generate] [OPTIONS]
+  prompt2json COMMAND [OPTIONS]
+
+Commands:
+  generate                   Send the prompt and write the validated JSON result (the default)
+  validate                   Validate JSON from stdin against the schema without calling the API
+  count-tokens               Count the prompt tokens of the requests without generating
+  list-models                List the models with a built-in default location, price, or deprecation
+  lint-schema                Check that the schemas compile and summarize them
+  (prompt2json COMMAND --help lists the options of a command)
+
+Required:
+  --system-instruction TEXT | --system-instruction-file PATH | --system-instruction-template PATH
+                            | --system-instruction-env NAME
+  --schema JSON             | --schema-file PATH | --schema-env NAME
+                              (--schema - reads the schema from stdin; the prompt then needs
+                              --prompt, --prompt-file, or --prompt-env)
+  --project ID
+  --location REGION
+  --model NAME
+
+Model:
+  --model-fallback-on-429 NAME
+                             Retry with this model when the primary model returns 429
+  --allowed-models LIST      Comma-separated model IDs that are permitted; any other --model or
+                             --model-fallback-on-429 is a usage error (default: any model)
+  --model-locations PATH     JSON object of model names to the location used when --location is
+                             not set (extends the built-in defaults for single-region models)
+  --deprecated-models PATH   JSON object of deprecated model ID substrings to suggested replacements
+                             (extends the built-in list; "" removes an entry)
+  --location REGION,REGION   Try each location in order on connection or 5xx failures
+
+System instruction template:
+  --system-instruction-template PATH
+                             Read the system instruction from a template with ${NAME} variables
+  --set NAME=VALUE           Template variable (repeatable); unset variables fall back to the
+                             environment, and unresolved variables are an error
+
+Schema selection:
+  --schema-file PATH         Repeatable; without --schema-select the response must pass every
+                             schema (the first is sent to Gemini)
+  --schema-select NAME       Schema to use, matched by top-level $id or file name without extension
+  --schema-cache N           Cache up to N compiled schemas by content hash so that identical
+                             schemas are compiled once
+
+Validation:
+  --allow-remote-refs        Resolve schema $ref URLs over HTTP(S) (fetched once per run)
+  --use-embedded-schema MODE Validate against the schema URL in the response's top-level $schema:
+                             also (with the provided schemas) or instead of them; requires
+                             --allow-remote-refs
+  --validate-only-against-draft DRAFT
+                             Also validate each response under DRAFT (4, 6, 7, 2019-09, 2020-12)
+                             and report where the result differs; the outcome is unchanged
+  --lenient-schema-json      Accept // and /* */ comments and trailing commas in schemas
+  --strict-schema            Before the request, fail on any $ref that does not resolve, including
+                             in unreferenced definitions and --gen-schema-file, naming its pointer
+  --validate-pointer PTR     Validate only the value at this JSON Pointer (e.g. /result) against
+                             the schema; the rest of the response passes through unvalidated
+  --min-confidence N         Fail (exit 8) when the confidence value is below N
+  --confidence-pointer PTR   JSON Pointer to the confidence value (default: /confidence)
+  --validation-exit-code N   Exit status used for validation failures (default: 4)
+  --max-errors N             Most distinct schema validation failures listed per schema, most
+                             relevant first (default: 10)
+  --strict-json-number       Preserve numbers as written and fail when a value typed integer in
+                             the schema is not written as an integer (such as 5.0)
+  --coerce-integers          With --strict-json-number, rewrite integral values such as 5.0 as 5
+                             instead of failing
+  --apply-defaults           Fill absent properties of the validated result with their schema
+                             default values
+  --fail-on-empty-object     Fail validation when the response is {} or [] even if the schema
+                             allows it
+  --extract-first-json       Validate the first balanced JSON object or array in the response text,
+                             ignoring any text before or after it
+  --retry-on-validation N    Re-issue the identical request up to N times when the response
+                             fails validation, logging the outcome of each attempt
+  --degrade-schema N         After N validation failures, retry once with a simplified schema
+                             (value constraints such as enum and minimum removed) and mark the
+                             result as degraded
+  --accept-finish-reasons LIST
+                             Finish reasons besides STOP (comma-separated) whose response is
+                             validated instead of rejected; SAFETY and RECITATION are never accepted
+  --accept-truncated         Accept a response cut off at the output token limit (MAX_TOKENS)
+                             if it still parses and validates; a warning is always printed
+  --retry-unknown-finish     Retry a response with an unrecognized finish reason like a transient
+                             API failure (with --max-retries) instead of failing validation
+
+Generation schema:
+  --gen-schema-file PATH     Schema sent to Gemini as responseJsonSchema; the response is still
+                             validated locally against --schema / --schema-file
+  --emit-property-ordering   Add propertyOrdering to each object of the sent schema, listing its
+                             properties in the order they are declared
+  --warn-schema-bytes N      Warn when the serialized schema sent to the API is larger than N bytes,
+                             noting how much of it is annotations such as description
+
+Input:
+  --prompt TEXT              Prompt text (default: read from stdin)
+  --prompt-file PATH         Read prompt from file (mutually exclusive with --prompt); repeat to
+                             join several files in order
+  --prompt-file-separator STR
+                             Placed between repeated --prompt-file contents (default: \n\n)
+  --prompt-env NAME          Read prompt from the environment variable NAME, keeping it out of
+                             process listings (mutually exclusive with --prompt and --prompt-file)
+  --parts-file PATH          Read the user turn from a JSON array of text and file parts, sent in
+                             order, instead of the prompt followed by the attachments
+  --request-template PATH    Build the request on a partial generateContent request JSON, for
+                             fields without an option such as safetySettings or routingConfig
+  --prompt-template TEXT     Render prompt from JSON read on stdin using a Go text/template
+  --prompt-delimiter STR     Split stdin into multiple prompts on STR (escapes like \n, \0)
+  --results-format FORMAT    Results of multiple prompts: ndjson (default) or array
+  --repl                     Read prompts from stdin line by line and print a result for each,
+                             reusing the connection and credentials until EOF
+  --attach PATH              Attach file (repeatable): png, jpg/jpeg, webp, pdf; a gs://BUCKET/OBJECT
+                             path is downloaded with the API credentials and inlined
+                             PATH#LABEL sends the text "Attachment: LABEL" before the file
+                             Use - to read a single attachment from stdin
+  --attach-type TYPE         Type of the stdin attachment: png, jpg, jpeg, webp, pdf
+  --max-attachments N        Most --attach files accepted before failing (default: 100)
+  --attachments-first        Send the attachments before the prompt text (default: text first)
+  --require-attachments      Fail when no attachment is given, such as from an empty glob
+  --dedup-attachments        Skip an attachment whose content is identical to an earlier one
+
+PDF chunking:
+  --pdf-chunk-pages N        Split the PDF attachment into chunks of N pages, run the prompt
+                             per chunk, and merge the validated results
+  --merge-strategy STRATEGY  concat (default): concatenate array results
+                             merge: deep-merge object results
+
+Grounding:
+  --grounding                Enable grounding with Google Search
+  --grounding-file PATH      Write grounding metadata (search queries, sources) to file
+
+Sampling:
+  --temperature N            Sampling temperature, 0 to 2 (default: model default)
+  --top-k N                  Sample from the N most likely tokens (default: model default)
+  --seed N                   Sampling seed (default: none)
+  --deterministic            Preset of --temperature 0 --top-k 1 --seed 0 with a single candidate;
+                             individual flags override the preset
+
+Log probabilities:
+  --logprobs N               Request token log probabilities with the top N candidates (1-20)
+  --logprobs-file PATH       Write the returned logprobsResult to file (required with --logprobs)
+
+Output:
+  --out PATH                 Write JSON to file (default: stdout)
+  --pretty-print             Pretty-print JSON output (default: minified)
+  --bom                      Prefix output with a UTF-8 byte order mark
+  --crlf                     Use CRLF (Windows) line endings in output
+  --trailing-newline=false   Omit the newline that ends the output on stdout and in --out files
+  --audit-log PATH           Append a JSON audit record per invocation: hashes of the instruction,
+                             prompt, schemas, and attachments, token usage, and status
+  --metrics-file PATH        Replace PATH with Prometheus text-format metrics of the run (requests,
+                             request duration, tokens, validation failures) for a textfile collector
+  --baseline-file PATH       Compare the result with a previous result and report the added,
+                             removed, and changed values as JSON on stderr
+  --diff-file PATH           Write the --baseline-file differences to file instead of stderr
+  --fail-on-diff             Exit with status 9 when the result differs from --baseline-file
+  --errors-file PATH         Append a JSON record per failure: {id, stage, message, exitCode}
+  --transform COMMAND        Pipe the validated JSON through a shell command (stdin to stdout)
+                             and validate its output against the schema again
+  --embed-metadata           Wrap the validated result as {"result": ..., "meta": {...}}
+  --pretty-stdout            With --out, also print a pretty-printed copy to stdout
+  --normalize                Canonical JSON output (RFC 8785): sorted keys, minified, normalized numbers
+  --sorted                   Byte-stable output: sorted keys, numbers exactly as returned, fixed
+                             escaping and indentation; combine with --pretty-print for indented output
+  --no-sort-keys             Keep object keys in the order the model wrote them instead of sorting them
+
+Cost estimate:
+  --estimate-cost            Count the prompt tokens with the countTokens API and print the
+                             estimated prompt cost as JSON without generating a response
+  --price-file PATH          JSON object of model names to USD prices per 1,000 prompt tokens
+                             (extends the built-in prices)
+  --benchmark N              Send the request N times and log the p50/p95/p99 latency, success
+                             rate, and throughput to stderr instead of writing the result
+  --concurrency N            Benchmark requests in flight at once (default: 1)
+  --benchmark-results        Also write the result of each successful benchmark request as NDJSON
+  --no-cache-prompt          End each request with a unique nonce part so context caching and
+                             server-side deduplication cannot serve it (adds a few prompt tokens)
+
+Dry-run (debug):
+  --dump-effective-config    Print the resolved configuration (flags, environment, defaults) as
+                             JSON and exit without making the request
+  --show-url                 Output the API URL without making the request (alias: --print-url)
+  --show-request-body        Output the JSON request body without making the request
+  --wrap-base64 MODE         With --show-request-body, make attachment data readable: wrap splits
+                             it into lines (not valid JSON), truncate cuts it with a length note
+  --emit-request-hash        Output a SHA-256 of the model and canonical request body, stable
+                             across runs and systems, without making the request
+  --print-gen-schema         Output the schema sent as responseJsonSchema, after --gen-schema-file
+                             and --emit-property-ordering are applied, without making the request
+  --json-schema-to-openapi   Output the --schema converted to the OpenAPI subset accepted as
+                             responseSchema and exit; only the schema options are required
+
+Credentials:
+  --credentials-source SOURCE
+                             adc (default): application default credentials
+                             metadata: only the GCE/GKE metadata server
+                             file: only the JSON file given by --credentials-file
+  --credentials-file PATH    Credentials JSON file used with --credentials-source file
+  --scope SCOPE              OAuth scope requested for the access token (repeatable), as a URL or
+                             a short name such as cloud-platform (default: cloud-platform)
+  --quota-project ID         Project charged for quota and billing (X-Goog-User-Project header),
+                             for user credentials without a quota project; --project still
+                             names the project that serves the model
+
+Misc:
+  --request-id ID            Request ID sent as X-Request-Id and prefixed to stderr diagnostics
+                             (default: random UUID)
+  --timeout SECONDS          HTTP request timeout in seconds (default: 60)
+  --connect-timeout SECONDS  Timeout for each of the TCP connection and the TLS handshake, within
+                             --timeout (default: 30 to connect, 10 for TLS)
+  --auth-timeout SECONDS     Timeout for obtaining the access token, such as from the metadata
+                             server; 0 waits indefinitely (default: --timeout)
+  --max-response-bytes N     Fail when an API response body exceeds N bytes (default: 67108864,
+                             64 MiB)
+  --strict-content-type      Fail with an API error quoting the start of the body when a successful
+                             response is not JSON, such as an HTML page from a proxy
+  --prefer-ipv4              Connect over IPv4 first, falling back to IPv6 (default: dual-stack)
+  --max-retries N            Retry transient API failures (5xx, network, 429) up to N times (default: 0)
+  --retry-jitter MODE        Randomize the retry backoff: none (default), full (0 to the delay), or
+                             equal (half the delay to the delay)
+  --retry-seed N             Seed the --retry-jitter randomness for reproducible retry timing
+  --verbose                  Log all diagnostics to stderr (same as --verbosity 3)
+  --verbosity N              Log diagnostics up to level N: 1 configuration summary, 2 request and
+                             response metadata, 3 timing and raw response text (default: 0)
+  -v                         Raise the verbosity by one level; repeat as -v -v for level 2
+  --quiet                    Suppress advisory warnings, such as for deprecated models
+  --fail-on-warnings         Exit with status 10 and a summary when any advisory warning fires,
+                             even with --quiet
+  --log-file PATH            Also append each diagnostic to file as JSON lines:
+                             {timestamp, requestId, stage, message}
+  --syslog                   Also write each diagnostic to the system log (Unix only)
+  --syslog-priority PRIORITY [facility.]severity of the entries (default: user.info)
+  --syslog-tag TAG           Tag of the entries (default: prompt2json)
+  --syslog-results           With --syslog, also write each result to the system log; stdout
+                             is unchanged
+  --full-raw                 At verbosity 3, log the full raw response text (default: first 2000 bytes)
+  --status-line              End stderr with p2j-result: {"status":...,"exitCode":N} for wrappers
+  --version                  Print version and exit
+  --help                     Print help and exit
+
+Environment (used if option not set):
+  --project         GOOGLE_CLOUD_PROJECT, CLOUDSDK_CORE_PROJECT
+  --quota-project   GOOGLE_CLOUD_QUOTA_PROJECT
+  --location        GOOGLE_CLOUD_LOCATION, GOOGLE_CLOUD_REGION, CLOUDSDK_COMPUTE_REGION
+  --timeout         P2J_TIMEOUT
+  --max-retries     P2J_MAX_RETRIES
+  --allowed-models  P2J_ALLOWED_MODELS
+
+Exit status:
+  0 success, 2 usage, 3 input, 4 validation/response, 5 API, 6 quota exceeded,
+  7 auth/permission, 8 below minimum confidence, 9 differs from baseline,
+  10 advisory warnings with --fail-on-warnings
+
+JSON Processing:
+  - LLM responses are validated as parsable JSON
+  - Valid JSON is validated against the provided schema
+  - JSON is minified by default; use --pretty-print for human-readable output
+  - Output is only written to STDOUT when validation succeeds
+  - Validation errors are written to STDERR
+
+Example:
+  echo "this is great" | prompt2json \
+    --system-instruction "Classify sentiment" \
+    --schema '{"type":"object","properties":{"sentiment":{"type":"string","enum":["POSITIVE","NEGATIVE","NEUTRAL"]},"confidence":{"type":"integer","minimum":0,"maximum":100}},"required":["sentiment","confidence"]}' \
+    --project example-project \
+    --location us-central1 \
+    --model gemini-2.5-flash
+`)
+}
+
+type Config struct {
+	SystemInstruction       string
+	SystemInstructionSrc    string // Source: "flag" or file path
+	SystemInstructionSHA256 string // Hash of the effective system instruction, for detecting changes between runs
+	Schema                  map[string]interface{}
+	SchemaSrc               string                 // Source: "flag" or file path
+	GenSchema               map[string]interface{} // Schema sent to the API; nil sends Schema
+	GenSchemaSrc            string                 // Source file path of GenSchema
+	PropertyOrdering        bool                   // Add propertyOrdering to the sent schema in declaration order
+	SentSchemaBytes         []byte                 // Original bytes of the schema sent to the API, which keep the declaration order
+	CompiledSchemas         []compiledSchema       // Every schema the response must pass; the first is compiled from Schema
+	CrossCheckDraft         *jsonschema.Draft      // Draft of --validate-only-against-draft, or nil
+	EmbeddedSchema          string                 // --use-embedded-schema mode, "" when responses are not checked against their $schema
+	SchemaCache             *schemaCache           // Compiled schemas by content hash; nil disables caching
+	ValidatePointer         string                 // JSON Pointer to the validated subtree; empty validates the whole response
+	ValidateTokens          []string               // Parsed reference tokens of ValidatePointer
+	MinConfidence           *float64               // Minimum accepted confidence; nil disables the check
+	ConfidencePointer       string                 // JSON Pointer to the confidence value
+	ConfidenceTokens        []string               // Parsed reference tokens of ConfidencePointer
+	Prompt                  string
+	PromptSrc               string       // Source: "stdin", "flag", "template", or file path
+	Prompts                 []string     // Prompts split from STDIN with --prompt-delimiter; each is processed in turn
+	PromptParts             []promptPart // Ordered parts from --parts-file; nil sends Prompt before the attachments
+	RequestTemplate         []byte       // Partial request body from --request-template that requests are merged into
+	ResultsFormat           string       // How the results of multiple prompts are combined: ndjson or array
+	REPL                    bool         // Read prompts from STDIN line by line until EOF
+	Project                 string
+	QuotaProject            string // Sent as X-Goog-User-Project when set
+	Location                string
+	Locations               []string // All locations to try in order; Location is the first
+	Model                   string
+	FallbackModel           string             // Model used when the primary model is quota-throttled
+	AcceptTruncated         bool               // Accept a MAX_TOKENS response if it still passes validation
+	RetryUnknownFinish      bool               // Report an unrecognized finish reason as a retryable API error
+	AcceptFinishReasons     []string           // Finish reasons other than STOP whose response is passed on to validation
+	FailOnEmpty             bool               // Reject an empty top-level object or array even when the schema allows it
+	ExtractFirstJSON        bool               // Validate only the first balanced JSON value in the response text
+	StrictNumbers           bool               // Decode numbers exactly and require integer literals where the schema types integer
+	CoerceIntegers          bool               // Rewrite integral non-literal values as integers instead of failing
+	ApplyDefaults           bool               // Fill absent properties with schema defaults after validation
+	DegradeAfter            int                // Validation failures before retrying with DegradedSchema; 0 disables
+	RetryOnValidation       int                // Times the identical request is re-issued after a validation failure
+	Benchmark               int                // Requests sent by --benchmark; 0 makes a single request
+	Concurrency             int                // Benchmark requests in flight at once
+	BenchmarkResults        bool               // Write each successful benchmark result
+	NoCachePrompt           bool               // End each request with a unique nonce part
+	WrapBase64              string             // How --show-request-body displays base64 data; empty shows it as sent
+	DegradedSchema          compiledSchema     // The primary schema with value constraints removed
+	Degraded                bool               // The result was generated and validated with DegradedSchema
+	AuditLog                string             // Append-only audit log of invocations
+	MetricsFile             string             // Prometheus text-format metrics file replaced after the run
+	BaselineFile            string             // Previous result the written result is compared with
+	Baseline                interface{}        // Decoded --baseline-file
+	DiffFile                string             // Receives the baseline differences instead of STDERR
+	FailOnDiff              bool               // A difference from the baseline is a driftError
+	FailOnWarnings          bool               // Any advisory warning fails the run with a warningError
+	Warnings                *advisoryWarnings  // Advisory warnings recorded for --fail-on-warnings
+	Metrics                 *runMetrics        // API requests and validation failures counted for MetricsFile
+	PriceFile               string             // Prices per 1,000 prompt tokens that extend the built-in table
+	Usage                   *tokenUsage        // Token usage accumulated over every API call of the run
+	AttachmentDigests       []attachmentDigest // Name and SHA-256 of each attachment for the audit log
+	Timeout                 int
+	MaxRetries              int
+	RetryBackoff            *retryBackoff // Delays between retries, with the --retry-jitter strategy
+	PreferIPv4              bool          // Dial IPv4 addresses before IPv6
+	ConnectTimeout          int           // Seconds allowed for the TCP connection and TLS handshake; 0 keeps the defaults
+	AuthTimeout             int           // Seconds allowed for obtaining the access token; 0 waits indefinitely
+	MaxResponseBytes        int64         // Largest response body read from the API
+	StrictContentType       bool          // Reject a status 200 response whose Content-Type is not JSON
+	CredentialsSource       string        // How the access token is obtained: adc, metadata, or file
+	CredentialsFile         string        // Credentials JSON file for the file source
+	Scopes                  []string      // OAuth scopes requested for the access token
+	OutFile                 string
+	Verbosity               int // Level of diagnostics logged to STDERR, from 0 to 3
+	PrettyPrint             bool
+	Normalize               bool
+	Sorted                  bool // Serialize with sortedJSON, decoding numbers as json.Number
+	NoSortKeys              bool // Serialize objects in response order, from a second order-preserving decode
+	PrettyStdout            bool // Print a pretty-printed copy to STDOUT in addition to OutFile
+	EmbedMetadata           bool // Wrap the validated result in a {result, meta} envelope
+	BOM                     bool // Prefix output with a UTF-8 byte order mark
+	CRLF                    bool // Use CRLF line endings in output
+	TrailingNewline         bool // End the output with a newline
+	Grounding               bool
+	GroundingFile           string
+	Logprobs                int      // Number of top candidate tokens with log probabilities; 0 disables
+	LogprobsFile            string   // Sidecar file for the returned logprobsResult
+	Temperature             *float64 // Sampling settings; nil leaves the model default
+	TopK                    *int
+	Seed                    *int
+	CandidateCount          int           // Number of candidates requested; 0 leaves the model default
+	AttachType              string        // Type of the attachment read from STDIN
+	AttachmentLabels        []string      // Label of each --attach path, "" when unlabeled
+	MaxAttachments          int           // Most --attach files accepted
+	AttachmentsFirst        bool          // Send the attachments before the prompt text
+	RequireAttachments      bool          // Fail rather than send a request without attachments
+	DedupAttachments        bool          // Skip attachments whose content hash matches an earlier one
+	MaxErrors               int           // Most validation failures listed per schema
+	PDFChunkPages           int           // Pages per chunk of the PDF attachment; 0 sends the PDF whole
+	MergeStrategy           string        // How chunk results are merged: concat or merge
+	PDFChunkParts           []interface{} // Attachment parts of each PDF chunk, in page order
+	PDFChunkIndex           int           // Position of the PDF among the attachment parts
+	FullRaw                 bool          // Log the whole raw response text in verbose mode
+	Transform               string        // Shell command the validated JSON is piped through before output
+	RequestID               string        // Sent as the X-Request-Id header and prefixed to every diagnostic
+	Session                 *apiSession   // HTTP client and credentials shared by every request; nil creates them per request
+	Log                     *logger       // Diagnostics written to STDERR
+	Syslog                  io.Writer     // System log that receives each result with --syslog-results; nil disables
+}
+
+func loadConfiguration() (*Config, error) {
+	config := &Config{
+		OutFile:            outFile,
+		PrettyPrint:        prettyPrint,
+		Normalize:          normalize,
+		Sorted:             sortedOutput,
+		NoSortKeys:         noSortKeys,
+		PrettyStdout:       prettyStdout,
+		EmbedMetadata:      embedMetadata,
+		BOM:                writeBOM,
+		CRLF:               writeCRLF,
+		TrailingNewline:    trailingNewline,
+		Grounding:          grounding,
+		AcceptTruncated:    acceptTruncated,
+		RetryUnknownFinish: retryUnknownFinish,
+		GroundingFile:      groundingFile,
+		FullRaw:            fullRaw,
+		Transform:          transformCommand,
+		PreferIPv4:         preferIPv4,
+		StrictContentType:  strictContentType,
+		FailOnEmpty:        failOnEmpty,
+		ExtractFirstJSON:   extractFirstJSONValue,
+		AuditLog:           auditLog,
+		PriceFile:          priceFile,
+		Usage:              &tokenUsage{},
+		MetricsFile:        metricsFile,
+		BaselineFile:       baselineFile,
+		DiffFile:           diffFile,
+		FailOnDiff:         failOnDiff,
+		FailOnWarnings:     failOnWarnings,
+		Warnings:           &advisoryWarnings{},
+		Metrics:            &runMetrics{},
+	}
+
+	// Every diagnostic is prefixed with the request ID so that a single call can be traced across logs
+	config.RequestID = requestID
+	if config.RequestID == "" {
+		id, err := newRequestID()
+		if err != nil {
+			return nil, &cliError{fmt.Sprintf("failed to generate request ID: %v", err)}
+		}
+		config.RequestID = id
+	}
+	for _, r := range config.RequestID {
+		if r < 0x21 || r > 0x7e {
+			return nil, &cliError{"--request-id must contain only printable ASCII characters without spaces"}
+		}
+	}
+	config.Log = newLogger(os.Stderr)
+	if logFile != "" {
+		file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to open log file: %v", err)}
+		}
+		config.Log = config.Log.withFile(file)
+	}
+	if syslogEnabled {
+		writer, err := openSyslog(syslogPriority, syslogTag)
+		if err != nil {
+			return nil, err
+		}
+		config.Log = config.Log.withSystem(writer)
+		if syslogResults {
+			config.Syslog = writer
+		}
+	} else if isFlagSet("syslog-priority") || isFlagSet("syslog-tag") || syslogResults {
+		return nil, &cliError{"--syslog-priority, --syslog-tag, and --syslog-results require --syslog"}
+	}
+	config.Log = config.Log.withPrefix(config.RequestID)
+
+	// Labels are split off first, so that every later check sees the plain attachment paths
+	for i, arg := range attachments {
+		path, label := splitAttachmentLabel(arg)
+		attachments[i] = path
+		config.AttachmentLabels = append(config.AttachmentLabels, label)
+	}
+
+	// --verbose keeps its meaning of logging everything; -v raises the level one step at a time
+	switch {
+	case isFlagSet("verbosity") && (verbose || verboseCount > 0):
+		return nil, &cliError{"--verbosity cannot be combined with --verbose or -v"}
+	case verbose && verboseCount > 0:
+		return nil, &cliError{"--verbose cannot be combined with -v"}
+	case isFlagSet("verbosity"):
+		if verbosity < 0 || verbosity > verbosityDetail {
+			return nil, &cliError{fmt.Sprintf("--verbosity must be between 0 and %d", verbosityDetail)}
+		}
+		config.Verbosity = verbosity
+	case verbose:
+		config.Verbosity = verbosityDetail
+	default:
+		config.Verbosity = min(int(verboseCount), verbosityDetail)
+	}
+
+	if normalize && prettyPrint {
+		return nil, &cliError{"cannot specify both --normalize and --pretty-print"}
+	}
+	if normalize && sortedOutput {
+		return nil, &cliError{"cannot specify both --normalize and --sorted"}
+	}
+	if noSortKeys && (normalize || sortedOutput) {
+		return nil, &cliError{"cannot specify --no-sort-keys with --normalize or --sorted, which sort keys"}
+	}
+
+	if validationExitCode < 1 || validationExitCode > 255 {
+		return nil, &cliError{"--validation-exit-code must be between 1 and 255"}
+	}
+	if maxErrors < 1 {
+		return nil, &cliError{"--max-errors must be at least 1"}
+	}
+	config.MaxErrors = maxErrors
+
+	for _, reason := range strings.Split(acceptFinishReasons, ",") {
+		reason = strings.ToUpper(strings.TrimSpace(reason))
+		switch {
+		case reason == "", reason == "STOP":
+			continue
+		case slices.Contains(nonOverridableFinishReasons, reason):
+			return nil, &cliError{fmt.Sprintf("--accept-finish-reasons cannot accept %s, which stops generation for safety or policy reasons", reason)}
+		case reason == "MAX_TOKENS":
+			// Truncation has its own warning and handling
+			config.AcceptTruncated = true
+		default:
+			config.AcceptFinishReasons = append(config.AcceptFinishReasons, reason)
+		}
+	}
+
+	if coerceIntegers && !strictJSONNumber {
+		return nil, &cliError{"--coerce-integers requires --strict-json-number"}
+	}
+	config.StrictNumbers = strictJSONNumber
+	config.ApplyDefaults = applyDefaults
+	config.CoerceIntegers = coerceIntegers
+
+	if prettyStdout && outFile == "" {
+		return nil, &cliError{"--pretty-stdout requires --out"}
+	}
+
+	if priceFile != "" && !estimateCostOnly && activeCommand != listModelsCommand {
+		return nil, &cliError{"--price-file requires --estimate-cost"}
+	}
+
+	config.NoCachePrompt = noCachePrompt
+	if emitRequestHash && noCachePrompt {
+		return nil, &cliError{"--emit-request-hash cannot be combined with --no-cache-prompt, whose nonce makes every request distinct"}
+	}
+	if emitRequestHash && replMode {
+		return nil, &cliError{"--emit-request-hash cannot be combined with --repl"}
+	}
+	if wrapBase64 != "" {
+		config.WrapBase64 = strings.ToLower(wrapBase64)
+		switch {
+		case config.WrapBase64 != base64DisplayWrap && config.WrapBase64 != base64DisplayTruncate:
+			return nil, &cliError{fmt.Sprintf("invalid --wrap-base64 %q (expected wrap or truncate)", wrapBase64)}
+		case !showRequestBody:
+			return nil, &cliError{"--wrap-base64 requires --show-request-body"}
+		}
+	}
+
+	if isFlagSet("benchmark") {
+		switch {
+		case benchmark < 1:
+			return nil, &cliError{"--benchmark must be at least 1"}
+		case concurrency < 1:
+			return nil, &cliError{"--concurrency must be at least 1"}
+		case showURL || showRequestBody || emitRequestHash || printGenSchema || jsonSchemaToOpenAPI || estimateCostOnly:
+			return nil, &cliError{"--benchmark sends requests and cannot be combined with dry-run modes or --estimate-cost"}
+		case promptDelimiter != "" || replMode || pdfChunkPages > 0:
+			return nil, &cliError{"--benchmark sends a single request repeatedly and cannot be combined with --prompt-delimiter, --repl, or --pdf-chunk-pages"}
+		case groundingFile != "" || logprobsFile != "":
+			return nil, &cliError{"--benchmark cannot be combined with --grounding-file or --logprobs-file, which are written per response"}
+		}
+		config.Benchmark = benchmark
+		config.Concurrency = concurrency
+		config.BenchmarkResults = benchmarkResults
+	} else if isFlagSet("concurrency") || benchmarkResults {
+		return nil, &cliError{"--concurrency and --benchmark-results require --benchmark"}
+	}
+
+	if baselineFile != "" {
+		switch {
+		case promptDelimiter != "" || replMode || isFlagSet("benchmark"):
+			return nil, &cliError{"--baseline-file compares a single result and cannot be combined with --prompt-delimiter, --repl, or --benchmark"}
+		case showURL || showRequestBody || emitRequestHash || printGenSchema || jsonSchemaToOpenAPI || estimateCostOnly:
+			return nil, &cliError{"--baseline-file cannot be combined with dry-run modes or --estimate-cost, which write no result"}
+		}
+		baseline, err := loadBaseline(baselineFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Baseline = baseline
+	} else if diffFile != "" || failOnDiff {
+		return nil, &cliError{"--diff-file and --fail-on-diff require --baseline-file"}
+	}
+
+	if fullRaw && config.Verbosity < verbosityDetail {
+		return nil, &cliError{"--full-raw requires --verbose or --verbosity 3"}
+	}
+
+	if groundingFile != "" && !grounding {
+		return nil, &cliError{"--grounding-file requires --grounding"}
+	}
+
+	if isFlagSet("logprobs") && (logprobs < 1 || logprobs > 20) {
+		return nil, &cliError{"--logprobs must be between 1 and 20"}
+	}
+	if logprobs > 0 && logprobsFile == "" {
+		return nil, &cliError{"--logprobs requires --logprobs-file"}
+	}
+	if logprobsFile != "" && logprobs == 0 {
+		return nil, &cliError{"--logprobs-file requires --logprobs"}
+	}
+	config.Logprobs = logprobs
+	config.LogprobsFile = logprobsFile
+
+	// Sampling settings; --deterministic presets them and individual flags override the preset
+	if deterministic {
+		config.Temperature = new(float64)
+		config.TopK = new(int)
+		*config.TopK = 1
+		config.Seed = new(int)
+		config.CandidateCount = 1
+	}
+	if isFlagSet("temperature") {
+		if temperature < 0 || temperature > 2 {
+			return nil, &cliError{"--temperature must be between 0 and 2"}
+		}
+		value := temperature
+		config.Temperature = &value
+	}
+	if isFlagSet("top-k") {
+		if topK < 1 {
+			return nil, &cliError{"--top-k must be at least 1"}
+		}
+		value := topK
+		config.TopK = &value
+	}
+	if isFlagSet("seed") {
+		value := seed
+		config.Seed = &value
+	}
+
+	// Validate timeout and retries, which fall back to environment variables when not set
+	var err error
+	config.Timeout, err = getIntConfigValue("timeout", timeout, "P2J_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout < 0 {
+		return nil, &cliError{"--timeout must be non-negative"}
+	}
+	config.AuthTimeout = config.Timeout
+	if isFlagSet("auth-timeout") {
+		if authTimeout < 0 {
+			return nil, &cliError{"--auth-timeout must be non-negative"}
+		}
+		config.AuthTimeout = authTimeout
+	}
+
+	config.CredentialsSource = strings.ToLower(credentialsSource)
+	switch config.CredentialsSource {
+	case credentialsSourceADC, credentialsSourceMetadata:
+		if credentialsFile != "" {
+			return nil, &cliError{"--credentials-file requires --credentials-source file"}
+		}
+	case credentialsSourceFile:
+		if credentialsFile == "" {
+			return nil, &cliError{"--credentials-source file requires --credentials-file"}
+		}
+		config.CredentialsFile = credentialsFile
+	default:
+		return nil, &cliError{fmt.Sprintf("invalid --credentials-source %q (expected adc, metadata, or file)", credentialsSource)}
+	}
+
+	// Narrower scopes allow least-privilege credentials; short names are expanded to the full URL
+	config.Scopes = []string{cloudPlatformScope}
+	if isFlagSet("scope") {
+		config.Scopes = nil
+		for _, scope := range scopes {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			if !strings.Contains(scope, "://") {
+				scope = oauthScopePrefix + scope
+			}
+			config.Scopes = append(config.Scopes, scope)
+		}
+		if len(config.Scopes) == 0 {
+			return nil, &cliError{"--scope requires at least one non-empty OAuth scope"}
+		}
+	}
+
+	if maxResponseBytes < 1 {
+		return nil, &cliError{"--max-response-bytes must be at least 1"}
+	}
+	config.MaxResponseBytes = maxResponseBytes
+
+	if isFlagSet("connect-timeout") {
+		if connectTimeout < 1 {
+			return nil, &cliError{"--connect-timeout must be at least 1"}
+		}
+		config.ConnectTimeout = connectTimeout
+	}
+
+	config.MaxRetries, err = getIntConfigValue("max-retries", maxRetries, "P2J_MAX_RETRIES")
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxRetries < 0 {
+		return nil, &cliError{"--max-retries must be non-negative"}
+	}
+	switch retryJitter {
+	case retryJitterNone, retryJitterFull, retryJitterEqual:
+	default:
+		return nil, &cliError{fmt.Sprintf("invalid --retry-jitter %q (expected none, full, or equal)", retryJitter)}
+	}
+	if isFlagSet("retry-seed") && retryJitter == retryJitterNone {
+		return nil, &cliError{"--retry-seed requires --retry-jitter full or equal"}
+	}
+	config.RetryBackoff = newRetryBackoff(retryJitter, retrySeed, isFlagSet("retry-seed"))
+
+	if !activeCommand.schema {
+		return config, nil
+	}
+
+	// Load schema
+	if schema != "" && len(schemaFiles) > 0 {
+		return nil, &cliError{"cannot specify both --schema and --schema-file"}
+	}
+	if other := firstSetFlag("schema", schema, "schema-file", strings.Join(schemaFiles, "")); schemaEnv != "" && other != "" {
+		return nil, &cliError{fmt.Sprintf("--schema-env %s cannot be combined with --%s", schemaEnv, other)}
+	}
+	if schema == "" && len(schemaFiles) == 0 && schemaEnv == "" {
+		return nil, &cliError{"must specify either --schema, --schema-file, or --schema-env"}
+	}
+	if schemaSelect != "" && len(schemaFiles) == 0 {
+		return nil, &cliError{"--schema-select requires --schema-file"}
+	}
+
+	// Without --schema-select, multiple schema files are all validated; the first is sent to the API
+	var schemaBytes []byte
+	var additionalSchemaFiles []string
+	if schema == stdinPath {
+		// Only one input can be read from STDIN, so the prompt must come from a flag or file
+		if slices.Contains(attachments, stdinPath) {
+			return nil, &cliError{"--schema - and --attach - cannot both read from STDIN"}
+		}
+		if replMode {
+			return nil, &cliError{"--schema - cannot be combined with --repl, which reads the prompts from STDIN"}
+		}
+		if activeCommand == validateCommand {
+			return nil, &cliError{"--schema - cannot be used with validate, which reads the JSON to validate from STDIN"}
+		}
+		if activeCommand.request && !jsonSchemaToOpenAPI && prompt == "" && len(promptFiles) == 0 && promptEnv == "" {
+			return nil, &cliError{"--schema - reads the schema from STDIN; provide the prompt with --prompt, --prompt-file, or --prompt-env"}
+		}
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read schema from STDIN: %v", err)}
+		}
+		schemaBytes = content
+		config.SchemaSrc = "stdin"
+	} else if schema != "" {
+		schemaBytes = []byte(schema)
+		config.SchemaSrc = "flag"
+	} else if schemaEnv != "" {
+		content, err := readEnvContent("schema-env", schemaEnv)
+		if err != nil {
+			return nil, err
+		}
+		schemaBytes = []byte(content)
+		config.SchemaSrc = "env:" + schemaEnv
+	} else if len(schemaFiles) > 1 && schemaSelect == "" {
+		content, err := os.ReadFile(schemaFiles[0])
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read schema file: %v", err)}
+		}
+		schemaBytes = content
+		config.SchemaSrc = schemaFiles[0]
+		additionalSchemaFiles = schemaFiles[1:]
+	} else {
+		path, content, err := selectSchemaFile(schemaFiles, schemaSelect)
+		if err != nil {
+			return nil, err
+		}
+		schemaBytes = content
+		config.SchemaSrc = path
+
+		if config.Verbosity >= verbosityConfig && schemaSelect != "" {
+			config.Log.Printf("Schema selection: %s (from %d schema files)\n", schemaSelect, len(schemaFiles))
 		}
-		schemaBytes = content
-		config.SchemaSrc = schemaFile
 	}
 
 	// Parse and validate schema
+	if lenientSchemaJSON {
+		schemaBytes = relaxJSON(schemaBytes)
+	}
 	if err := json.Unmarshal(schemaBytes, &config.Schema); err != nil {
 		return nil, &inputError{fmt.Sprintf("invalid JSON in schema: %v", err)}
 	}
 
-	if verbose {
-		if config.SchemaSrc == "flag" {
-			fmt.Fprintf(os.Stderr, "Schema: %d bytes (from flag) - valid JSON\n", len(schemaBytes))
-		} else {
-			fmt.Fprintf(os.Stderr, "Schema: %d bytes (from %s) - valid JSON\n", len(schemaBytes), config.SchemaSrc)
+	if config.Verbosity >= verbosityConfig {
+		if config.SchemaSrc == "flag" {
+			config.Log.Printf("Schema: %d bytes (from flag) - valid JSON\n", len(schemaBytes))
+		} else {
+			config.Log.Printf("Schema: %d bytes (from %s) - valid JSON\n", len(schemaBytes), config.SchemaSrc)
+		}
+	}
+
+	// The metadata envelope must be distinguishable from a result that itself uses its keys
+	if embedMetadata {
+		if properties, ok := config.Schema["properties"].(map[string]interface{}); ok {
+			for _, key := range []string{"result", "meta"} {
+				if _, collides := properties[key]; collides {
+					return nil, &cliError{fmt.Sprintf("--embed-metadata cannot be used when the schema defines a top-level %q property", key)}
+				}
+			}
+		}
+	}
+
+	// Load the optional generation schema sent to the API in place of the validation schema
+	config.PropertyOrdering = emitPropertyOrdering
+	config.SentSchemaBytes = schemaBytes
+	if genSchemaFile != "" {
+		content, err := os.ReadFile(genSchemaFile)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read generation schema file: %v", err)}
+		}
+		if lenientSchemaJSON {
+			content = relaxJSON(content)
+		}
+		if err := json.Unmarshal(content, &config.GenSchema); err != nil {
+			return nil, &inputError{fmt.Sprintf("invalid JSON in generation schema: %v", err)}
+		}
+		config.GenSchemaSrc = genSchemaFile
+		config.SentSchemaBytes = content
+		// The generation schema is only sent, never compiled, so its references are not checked otherwise
+		if strictSchema {
+			if err := checkSchemaRefs(genSchemaFile, content, true); err != nil {
+				return nil, err
+			}
+		}
+
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Generation schema: %d bytes (from %s) - valid JSON\n", len(content), config.GenSchemaSrc)
+		}
+	}
+
+	// The schema is sent with every request, so a large one costs prompt tokens each time
+	if warnSchemaBytes < 0 {
+		return nil, &cliError{"--warn-schema-bytes cannot be negative"}
+	}
+	if warnSchemaBytes > 0 && (!quiet || config.FailOnWarnings) {
+		if err := warnLargeSchema(config, warnSchemaBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Compile the JSON Schemas once for reuse
+	if isFlagSet("schema-cache") {
+		if schemaCacheSize < 1 {
+			return nil, &cliError{"--schema-cache must be at least 1"}
+		}
+		config.SchemaCache = newSchemaCache(schemaCacheSize)
+	}
+	if strictSchema {
+		if err := checkSchemaRefs(config.SchemaSrc, schemaBytes, false); err != nil {
+			return nil, err
+		}
+	}
+	compiled, err := compileSchema(config, schemaBytes)
+	if err != nil {
+		return nil, err
+	}
+	config.CompiledSchemas = []compiledSchema{{Src: config.SchemaSrc, Schema: compiled, SHA256: sha256Hex(schemaBytes)}}
+	switch useEmbeddedSchema {
+	case "":
+	case embeddedSchemaAlso, embeddedSchemaInstead:
+		if !allowRemoteRefs {
+			return nil, &cliError{"--use-embedded-schema fetches the schema over HTTP(S) and requires --allow-remote-refs"}
+		}
+		// Defaults are taken from the provided schema, which instead leaves out of validation
+		if useEmbeddedSchema == embeddedSchemaInstead && applyDefaults {
+			return nil, &cliError{"--apply-defaults fills defaults from the provided schema and cannot be combined with --use-embedded-schema instead"}
+		}
+		config.EmbeddedSchema = useEmbeddedSchema
+	default:
+		return nil, &cliError{fmt.Sprintf("invalid --use-embedded-schema %q (expected also or instead)", useEmbeddedSchema)}
+	}
+	if crossCheckDraft != "" {
+		if config.CrossCheckDraft, err = parseSchemaDraft(crossCheckDraft); err != nil {
+			return nil, err
+		}
+		if config.CompiledSchemas[0].CrossCheck, err = compileCrossCheckSchema(config, config.SchemaSrc, schemaBytes, compiled); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range additionalSchemaFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read schema file: %v", err)}
+		}
+		if lenientSchemaJSON {
+			content = relaxJSON(content)
+		}
+		if !json.Valid(content) {
+			return nil, &inputError{fmt.Sprintf("invalid JSON in schema %s", path)}
+		}
+		if strictSchema {
+			if err := checkSchemaRefs(path, content, false); err != nil {
+				return nil, err
+			}
+		}
+		compiled, err := compileSchema(config, content)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("%s: %v", path, err)}
+		}
+		var crossCheck *jsonschema.Schema
+		if config.CrossCheckDraft != nil {
+			if crossCheck, err = compileCrossCheckSchema(config, path, content, compiled); err != nil {
+				return nil, err
+			}
+		}
+		config.CompiledSchemas = append(config.CompiledSchemas, compiledSchema{Src: path, Schema: compiled, SHA256: sha256Hex(content), CrossCheck: crossCheck})
+
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Schema: %d bytes (from %s) - valid JSON, validation only\n", len(content), path)
+		}
+	}
+
+	// The degraded schema is compiled up front so that a schema it breaks is reported before any request
+	if isFlagSet("degrade-schema") {
+		if degradeSchemaAfter < 1 {
+			return nil, &cliError{"--degrade-schema must be at least 1"}
+		}
+		degradedBytes, err := json.Marshal(degradeSchema(config.Schema))
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to degrade schema: %v", err)}
+		}
+		compiled, err := compileSchema(config, degradedBytes)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("degraded schema: %v", err)}
+		}
+		config.DegradeAfter = degradeSchemaAfter
+		config.DegradedSchema = compiledSchema{Src: config.SchemaSrc + " (degraded)", Schema: compiled, SHA256: sha256Hex(degradedBytes)}
+	}
+
+	if isFlagSet("retry-on-validation") {
+		if retryOnValidation < 1 {
+			return nil, &cliError{"--retry-on-validation must be at least 1"}
+		}
+		if config.DegradeAfter > 0 {
+			return nil, &cliError{"--retry-on-validation cannot be combined with --degrade-schema, which already retries before degrading"}
+		}
+		config.RetryOnValidation = retryOnValidation
+	}
+
+	if validatePointer != "" {
+		tokens, err := parseJSONPointer(validatePointer)
+		if err != nil {
+			return nil, &cliError{fmt.Sprintf("invalid --validate-pointer: %v", err)}
+		}
+		config.ValidatePointer = validatePointer
+		config.ValidateTokens = tokens
+	}
+
+	if isFlagSet("confidence-pointer") && !isFlagSet("min-confidence") {
+		return nil, &cliError{"--confidence-pointer requires --min-confidence"}
+	}
+	if isFlagSet("min-confidence") {
+		tokens, err := parseJSONPointer(confidencePointer)
+		if err != nil {
+			return nil, &cliError{fmt.Sprintf("invalid --confidence-pointer: %v", err)}
+		}
+		threshold := minConfidence
+		config.MinConfidence = &threshold
+		config.ConfidencePointer = confidencePointer
+		config.ConfidenceTokens = tokens
+	}
+
+	if config.Verbosity >= verbosityConfig {
+		config.Log.Printf("Schema validation: compiled successfully\n")
+		if cache := config.SchemaCache; cache != nil {
+			config.Log.Printf("Schema cache: %d hits, %d misses (%.0f%% hit rate)\n",
+				cache.hits, cache.misses, 100*float64(cache.hits)/float64(cache.hits+cache.misses))
+		}
+	}
+
+	// Only commands that send requests need the system instruction, prompt, attachments, and API
+	// settings; --json-schema-to-openapi only converts the schema
+	if !activeCommand.request || jsonSchemaToOpenAPI {
+		return config, nil
+	}
+
+	// Load system instruction
+	if other := firstSetFlag("system-instruction", systemInstruction, "system-instruction-file", systemInstructionFile, "system-instruction-env", systemInstructionEnv); systemInstructionTemplate != "" && other != "" {
+		return nil, &cliError{fmt.Sprintf("--system-instruction-template cannot be combined with --%s", other)}
+	}
+	if systemInstruction != "" && systemInstructionFile != "" {
+		return nil, &cliError{"cannot specify both --system-instruction and --system-instruction-file"}
+	}
+	if other := firstSetFlag("system-instruction", systemInstruction, "system-instruction-file", systemInstructionFile); systemInstructionEnv != "" && other != "" {
+		return nil, &cliError{fmt.Sprintf("--system-instruction-env %s cannot be combined with --%s", systemInstructionEnv, other)}
+	}
+	if systemInstruction == "" && systemInstructionFile == "" && systemInstructionEnv == "" && systemInstructionTemplate == "" {
+		return nil, &cliError{"must specify either --system-instruction, --system-instruction-file, --system-instruction-template, or --system-instruction-env"}
+	}
+	if len(templateVars) > 0 && systemInstructionTemplate == "" {
+		return nil, &cliError{"--set requires --system-instruction-template"}
+	}
+
+	if systemInstructionTemplate != "" {
+		content, err := os.ReadFile(systemInstructionTemplate)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read system instruction template: %v", err)}
+		}
+		vars, err := parseTemplateVars(templateVars)
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := expandTemplateVars(string(content), vars)
+		if err != nil {
+			return nil, err
+		}
+		config.SystemInstruction = strings.TrimSpace(expanded)
+		config.SystemInstructionSrc = systemInstructionTemplate
+	} else if systemInstruction != "" {
+		config.SystemInstruction = strings.TrimSpace(systemInstruction)
+		config.SystemInstructionSrc = "flag"
+	} else if systemInstructionEnv != "" {
+		content, err := readEnvContent("system-instruction-env", systemInstructionEnv)
+		if err != nil {
+			return nil, err
+		}
+		config.SystemInstruction = strings.TrimSpace(content)
+		config.SystemInstructionSrc = "env:" + systemInstructionEnv
+	} else {
+		content, err := os.ReadFile(systemInstructionFile)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read system instruction file: %v", err)}
+		}
+		config.SystemInstruction = strings.TrimSpace(string(content))
+		config.SystemInstructionSrc = systemInstructionFile
+	}
+
+	if config.SystemInstruction == "" {
+		return nil, &inputError{"system instruction cannot be empty"}
+	}
+	config.SystemInstructionSHA256 = sha256Hex([]byte(config.SystemInstruction))
+
+	if config.Verbosity >= verbosityConfig {
+		if config.SystemInstructionSrc == "flag" {
+			config.Log.Printf("System instruction: %d bytes (from flag, sha256 %s)\n", len(config.SystemInstruction), config.SystemInstructionSHA256)
+		} else {
+			config.Log.Printf("System instruction: %d bytes (from %s, sha256 %s)\n", len(config.SystemInstruction), config.SystemInstructionSrc, config.SystemInstructionSHA256)
+		}
+	}
+
+	// Validate attachment read from STDIN, which requires the prompt to come from elsewhere
+	stdinAttachments := 0
+	for _, path := range attachments {
+		if path == stdinPath {
+			stdinAttachments++
+		}
+	}
+	if stdinAttachments > 1 {
+		return nil, &cliError{"--attach - can only be specified once"}
+	}
+	if stdinAttachments == 1 {
+		if attachType == "" {
+			return nil, &cliError{"--attach - requires --attach-type"}
+		}
+		if promptDelimiter != "" {
+			return nil, &cliError{"--attach - cannot be combined with --prompt-delimiter, which reads the prompts from STDIN"}
+		}
+		if replMode {
+			return nil, &cliError{"--attach - cannot be combined with --repl, which reads the prompts from STDIN"}
+		}
+		if prompt == "" && len(promptFiles) == 0 && promptEnv == "" {
+			return nil, &cliError{"--attach - reads the attachment from STDIN; provide the prompt with --prompt, --prompt-file, or --prompt-env"}
+		}
+		config.AttachType = strings.ToLower(strings.TrimPrefix(attachType, "."))
+	} else if attachType != "" {
+		return nil, &cliError{"--attach-type requires --attach -"}
+	}
+	if maxAttachments < 1 {
+		return nil, &cliError{"--max-attachments must be at least 1"}
+	}
+	config.MaxAttachments = maxAttachments
+	config.AttachmentsFirst = attachmentsFirst
+	config.RequireAttachments = requireAttachments
+	config.DedupAttachments = dedupAttachments
+
+	// Validate PDF chunking, which requires exactly one PDF attachment
+	if isFlagSet("pdf-chunk-pages") {
+		if pdfChunkPages < 1 {
+			return nil, &cliError{"--pdf-chunk-pages must be at least 1"}
+		}
+		pdfAttachments := 0
+		for _, path := range attachments {
+			if strings.ToLower(filepath.Ext(path)) == ".pdf" || (path == stdinPath && config.AttachType == "pdf") {
+				pdfAttachments++
+			}
+		}
+		if pdfAttachments != 1 {
+			return nil, &cliError{"--pdf-chunk-pages requires exactly one PDF attachment"}
+		}
+		if promptDelimiter != "" {
+			return nil, &cliError{"--pdf-chunk-pages cannot be combined with --prompt-delimiter"}
+		}
+		config.MergeStrategy = strings.ToLower(mergeStrategy)
+		if config.MergeStrategy != mergeStrategyConcat && config.MergeStrategy != mergeStrategyMerge {
+			return nil, &cliError{fmt.Sprintf("invalid --merge-strategy %q (expected concat or merge)", mergeStrategy)}
+		}
+		config.PDFChunkPages = pdfChunkPages
+	} else if isFlagSet("merge-strategy") {
+		return nil, &cliError{"--merge-strategy requires --pdf-chunk-pages"}
+	}
+
+	// Load prompt
+	if prompt != "" && len(promptFiles) > 0 {
+		return nil, &cliError{"cannot specify both --prompt and --prompt-file"}
+	}
+	if isFlagSet("prompt-file-separator") && len(promptFiles) < 2 {
+		return nil, &cliError{"--prompt-file-separator requires --prompt-file to be repeated"}
+	}
+	if other := firstSetFlag("prompt", prompt, "prompt-file", strings.Join(promptFiles, "")); promptEnv != "" && other != "" {
+		return nil, &cliError{fmt.Sprintf("--prompt-env %s cannot be combined with --%s", promptEnv, other)}
+	}
+	if promptTemplate != "" && (prompt != "" || len(promptFiles) > 0 || promptEnv != "") {
+		return nil, &cliError{"--prompt-template reads JSON from STDIN and cannot be combined with --prompt, --prompt-file, or --prompt-env"}
+	}
+	if promptDelimiter != "" && (prompt != "" || len(promptFiles) > 0 || promptEnv != "") {
+		return nil, &cliError{"--prompt-delimiter splits STDIN and cannot be combined with --prompt, --prompt-file, or --prompt-env"}
+	}
+	if replMode {
+		switch {
+		case prompt != "" || len(promptFiles) > 0 || promptEnv != "" || promptTemplate != "":
+			return nil, &cliError{"--repl reads the prompts from STDIN and cannot be combined with --prompt, --prompt-file, --prompt-env, or --prompt-template"}
+		case promptDelimiter != "":
+			return nil, &cliError{"--repl cannot be combined with --prompt-delimiter"}
+		case config.PDFChunkPages > 0:
+			return nil, &cliError{"--pdf-chunk-pages cannot be combined with --repl"}
+		case outFile != "":
+			return nil, &cliError{"--repl writes each result to STDOUT and cannot be combined with --out"}
+		case estimateCostOnly:
+			return nil, &cliError{"--estimate-cost cannot be combined with --repl"}
+		case !trailingNewline:
+			return nil, &cliError{"--repl ends each result with a newline and cannot be combined with --trailing-newline=false"}
+		}
+		config.REPL = true
+		config.PromptSrc = "stdin"
+	}
+	if partsFile != "" {
+		switch {
+		case prompt != "" || len(promptFiles) > 0 || promptEnv != "" || promptTemplate != "":
+			return nil, &cliError{"--parts-file cannot be combined with --prompt, --prompt-file, --prompt-env, or --prompt-template"}
+		case promptDelimiter != "" || replMode:
+			return nil, &cliError{"--parts-file cannot be combined with --prompt-delimiter or --repl"}
+		case len(attachments) > 0:
+			return nil, &cliError{"--parts-file cannot be combined with --attach; add file parts to the parts file instead"}
+		case config.PDFChunkPages > 0:
+			return nil, &cliError{"--parts-file cannot be combined with --pdf-chunk-pages"}
+		case attachmentsFirst:
+			return nil, &cliError{"--parts-file sets the order of the parts and cannot be combined with --attachments-first"}
+		case dedupAttachments:
+			return nil, &cliError{"--parts-file cannot be combined with --dedup-attachments, since each file part has its place in the parts"}
+		}
+	}
+	if promptDelimiter == "" && isFlagSet("results-format") {
+		return nil, &cliError{"--results-format requires --prompt-delimiter"}
+	}
+
+	if replMode {
+		// Prompts are read one line at a time once the run starts
+	} else if promptDelimiter != "" {
+		config.ResultsFormat = strings.ToLower(resultsFormat)
+		if config.ResultsFormat != resultsFormatNDJSON && config.ResultsFormat != resultsFormatArray {
+			return nil, &cliError{fmt.Sprintf("invalid --results-format %q (expected ndjson or array)", resultsFormat)}
+		}
+		if config.ResultsFormat == resultsFormatNDJSON && prettyPrint {
+			return nil, &cliError{"--pretty-print cannot be used with NDJSON results; use --results-format array"}
+		}
+		delimiter, err := parseDelimiter("prompt-delimiter", promptDelimiter, false)
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read from STDIN: %v", err)}
+		}
+		config.PromptSrc = "stdin"
+		if promptTemplate != "" {
+			config.PromptSrc = "template"
+		}
+		for i, segment := range strings.Split(string(content), delimiter) {
+			segment = strings.TrimSpace(segment)
+			if segment == "" {
+				continue
+			}
+			if promptTemplate != "" {
+				rendered, err := renderPromptTemplate(promptTemplate, []byte(segment))
+				if err != nil {
+					return nil, &inputError{fmt.Sprintf("prompt %d: %v", i+1, err)}
+				}
+				segment = strings.TrimSpace(rendered)
+				if segment == "" {
+					return nil, &inputError{fmt.Sprintf("prompt %d: template rendered an empty prompt", i+1)}
+				}
+			}
+			config.Prompts = append(config.Prompts, segment)
+		}
+		if len(config.Prompts) == 0 {
+			return nil, &inputError{"no prompts found in STDIN"}
+		}
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Prompts: %d (from %s, split on %q)\n", len(config.Prompts), config.PromptSrc, delimiter)
+		}
+	} else if promptTemplate != "" {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read from STDIN: %v", err)}
+		}
+		rendered, err := renderPromptTemplate(promptTemplate, content)
+		if err != nil {
+			return nil, err
+		}
+		config.Prompt = strings.TrimSpace(rendered)
+		config.PromptSrc = "template"
+	} else if prompt != "" {
+		config.Prompt = strings.TrimSpace(prompt)
+		config.PromptSrc = "flag"
+	} else if partsFile != "" {
+		parts, err := loadPartsFile(partsFile)
+		if err != nil {
+			return nil, err
+		}
+		// File parts are loaded as attachments, in order, so the usual types and limits apply
+		var texts []string
+		for _, part := range parts {
+			if part.Type == partTypeText {
+				texts = append(texts, part.Text)
+			} else {
+				attachments = append(attachments, part.Path)
+			}
+		}
+		config.PromptParts = parts
+		config.Prompt = strings.Join(texts, "\n\n")
+		config.PromptSrc = partsFile
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Prompt parts: %d parts, %d text and %d file (from %s)\n", len(parts), len(texts), len(parts)-len(texts), partsFile)
+		}
+	} else if len(promptFiles) > 0 {
+		// Fragments such as instructions, examples, and data are trimmed and joined in order
+		separator, err := parseDelimiter("prompt-file-separator", promptFileSeparator, true)
+		if err != nil {
+			return nil, err
+		}
+		fragments := make([]string, 0, len(promptFiles))
+		for _, path := range promptFiles {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, &inputError{fmt.Sprintf("failed to read prompt file: %v", err)}
+			}
+			fragments = append(fragments, strings.TrimSpace(string(content)))
+		}
+		config.Prompt = strings.Join(fragments, separator)
+		config.PromptSrc = strings.Join(promptFiles, ",")
+		if config.Verbosity >= verbosityConfig && len(promptFiles) > 1 {
+			config.Log.Printf("Prompt files: %d files joined, %d bytes in total\n", len(promptFiles), len(config.Prompt))
+		}
+	} else if promptEnv != "" {
+		content, err := readEnvContent("prompt-env", promptEnv)
+		if err != nil {
+			return nil, err
+		}
+		config.Prompt = strings.TrimSpace(content)
+		config.PromptSrc = "env:" + promptEnv
+	} else {
+		// Read from STDIN
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read from STDIN: %v", err)}
+		}
+		config.Prompt = strings.TrimSpace(string(content))
+		config.PromptSrc = "stdin"
+	}
+
+	if config.Prompt == "" && len(config.Prompts) == 0 && !config.REPL && config.PromptParts == nil {
+		return nil, &inputError{"prompt cannot be empty"}
+	}
+
+	if config.Verbosity >= verbosityConfig && len(config.Prompts) == 0 && !config.REPL && config.PromptParts == nil {
+		switch config.PromptSrc {
+		case "stdin":
+			config.Log.Printf("Prompt: %d bytes (from stdin)\n", len(config.Prompt))
+		case "flag":
+			config.Log.Printf("Prompt: %d bytes (from flag)\n", len(config.Prompt))
+		case "template":
+			config.Log.Printf("Prompt: %d bytes (from template rendered with stdin JSON)\n", len(config.Prompt))
+		default:
+			config.Log.Printf("Prompt: %d bytes (from %s)\n", len(config.Prompt), config.PromptSrc)
+		}
+	}
+
+	if requestTemplate != "" {
+		config.RequestTemplate, err = loadRequestTemplate(requestTemplate)
+		if err != nil {
+			return nil, err
+		}
+		if config.Verbosity >= verbosityConfig {
+			config.Log.Printf("Request template: %d bytes (from %s)\n", len(config.RequestTemplate), requestTemplate)
+		}
+	}
+
+	// Load project, location, model with environment fallback
+	config.Project, err = resolveConfigValue("project", projectFlag, "GOOGLE_CLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT")
+	if err != nil {
+		return nil, err
+	}
+	if config.Project == "" {
+		return nil, &cliError{"--project is required (or set GOOGLE_CLOUD_PROJECT)"}
+	}
+
+	// Validate project ID
+	if !project.IsValidProjectID(config.Project) {
+		return nil, &inputError{fmt.Sprintf("invalid GCP project ID: %s", config.Project)}
+	}
+
+	// The quota project is billed for the calls, for user credentials that do not name one themselves
+	config.QuotaProject, err = resolveConfigValue("quota-project", quotaProjectFlag, "GOOGLE_CLOUD_QUOTA_PROJECT")
+	if err != nil {
+		return nil, err
+	}
+	if config.QuotaProject != "" && !project.IsValidProjectID(config.QuotaProject) {
+		return nil, &inputError{fmt.Sprintf("invalid GCP quota project ID: %s", config.QuotaProject)}
+	}
+
+	// A comma-separated list of locations is tried in order when a location is unavailable
+	locationValue, err := resolveConfigValue("location", locationFlag, "GOOGLE_CLOUD_LOCATION", "GOOGLE_CLOUD_REGION", "CLOUDSDK_COMPUTE_REGION")
+	if err != nil {
+		return nil, err
+	}
+	if locationValue == "" {
+		// Models only served from one location do not need --location
+		locations, err := loadModelLocations(modelLocationsFile)
+		if err != nil {
+			return nil, err
+		}
+		if defaultLocation, ok := locations[getConfigValue(modelFlag)]; ok {
+			locationValue = defaultLocation
+			if config.Verbosity >= verbosityConfig {
+				config.Log.Printf("Location: %s (default for model %s since --location is not set)\n", defaultLocation, getConfigValue(modelFlag))
+			}
+		}
+	}
+	for _, loc := range strings.Split(locationValue, ",") {
+		loc = strings.TrimSpace(loc)
+		if loc == "" {
+			continue
+		}
+		// Validate region (allow "global" for Vertex AI models that are only available globally)
+		if loc != "global" && !location.IsValidRegion(loc) {
+			return nil, &inputError{fmt.Sprintf("invalid GCP region: %s", loc)}
+		}
+		config.Locations = append(config.Locations, loc)
+	}
+	if len(config.Locations) == 0 {
+		return nil, &cliError{"--location is required (or set GOOGLE_CLOUD_LOCATION)"}
+	}
+	config.Location = config.Locations[0]
+
+	config.Model = getConfigValue(modelFlag)
+	if config.Model == "" {
+		return nil, &cliError{"--model is required"}
+	}
+
+	// Validate model name
+	if !vertexai.IsValidVertexModelName(config.Model) {
+		return nil, &inputError{fmt.Sprintf("invalid Vertex AI model name: %s", config.Model)}
+	}
+
+	if fallbackModel != "" {
+		if !vertexai.IsValidVertexModelName(fallbackModel) {
+			return nil, &inputError{fmt.Sprintf("invalid Vertex AI model name for --model-fallback-on-429: %s", fallbackModel)}
+		}
+		if fallbackModel == config.Model {
+			return nil, &cliError{"--model-fallback-on-429 must differ from --model"}
+		}
+		config.FallbackModel = fallbackModel
+	}
+
+	// An allowlist guards against accidentally using models that are not meant to be used
+	if list := getConfigValue(allowedModels, "P2J_ALLOWED_MODELS"); list != "" {
+		var allowed []string
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				allowed = append(allowed, name)
+			}
+		}
+		for _, model := range []string{config.Model, config.FallbackModel} {
+			if model != "" && !slices.Contains(allowed, model) {
+				return nil, &cliError{fmt.Sprintf("model %s is not allowed (allowed models: %s)", model, strings.Join(allowed, ", "))}
+			}
+		}
+	}
+
+	// Deprecated models still work, so they are only pointed out
+	if !quiet || config.FailOnWarnings {
+		deprecated, err := loadDeprecatedModels(deprecatedModelsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, model := range []string{config.Model, config.FallbackModel} {
+			if replacement, ok := deprecatedReplacement(deprecated, model); ok && model != "" {
+				warnAdvisory(config, warningDeprecatedModel, "model %s is deprecated; consider %s instead\n", model, replacement)
+			}
+		}
+	}
+
+	if config.Verbosity >= verbosityConfig {
+		config.Log.Printf("API configuration: project=%s location=%s model=%s\n", config.Project, strings.Join(config.Locations, ","), config.Model)
+		if config.QuotaProject != "" {
+			config.Log.Printf("Quota project: %s\n", config.QuotaProject)
+		}
+	}
+
+	return config, nil
+}
+
+// loadModelLocations returns the built-in model default locations merged with the entries of the
+// --model-locations file, which take precedence
+func loadModelLocations(path string) (map[string]string, error) {
+	locations := make(map[string]string, len(modelDefaultLocations))
+	for model, loc := range modelDefaultLocations {
+		locations[model] = loc
+	}
+	if path == "" {
+		return locations, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read model locations file: %v", err)}
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid model locations file (expected a JSON object of model names to locations): %v", err)}
+	}
+	for model, loc := range overrides {
+		locations[model] = loc
+	}
+	return locations, nil
+}
+
+// loadDeprecatedModels returns the built-in deprecated models merged with the entries of the
+// --deprecated-models file, which take precedence; an entry with an empty replacement is removed
+func loadDeprecatedModels(path string) (map[string]string, error) {
+	deprecated := make(map[string]string, len(deprecatedModelReplacements))
+	for model, replacement := range deprecatedModelReplacements {
+		deprecated[model] = replacement
+	}
+	if path == "" {
+		return deprecated, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read deprecated models file: %v", err)}
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid deprecated models file (expected a JSON object of model names to replacements): %v", err)}
+	}
+	for model, replacement := range overrides {
+		if replacement == "" {
+			delete(deprecated, model)
+		} else {
+			deprecated[model] = replacement
+		}
+	}
+	return deprecated, nil
+}
+
+// deprecatedReplacement returns the replacement for the longest deprecated substring of model
+func deprecatedReplacement(deprecated map[string]string, model string) (string, bool) {
+	match := ""
+	for substring := range deprecated {
+		if strings.Contains(model, substring) && (len(substring) > len(match) || (len(substring) == len(match) && substring < match)) {
+			match = substring
+		}
+	}
+	if match == "" {
+		return "", false
+	}
+	return deprecated[match], true
+}
+
+// parseDelimiter interprets Go-style escape sequences in the value of --prompt-delimiter or
+// --prompt-file-separator so that delimiters such as "\n---\n" or "\0" can be given on the command
+// line. Only a separator may be empty, which joins the contents directly.
+func parseDelimiter(flagName, value string, allowEmpty bool) (string, error) {
+	if value == `\0` {
+		return "\x00", nil
+	}
+	delimiter, err := strconv.Unquote(`"` + strings.ReplaceAll(value, `"`, `\"`) + `"`)
+	if err != nil {
+		return "", &cliError{fmt.Sprintf("invalid --%s %q: %v", flagName, value, err)}
+	}
+	if delimiter == "" && !allowEmpty {
+		return "", &cliError{fmt.Sprintf("--%s cannot be empty", flagName)}
+	}
+	return delimiter, nil
+}
+
+// Variable references in a system instruction template are written ${NAME}
+var (
+	templateVarPattern     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	templateVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// parseTemplateVars parses repeated --set NAME=VALUE flags into a map; later values win
+func parseTemplateVars(values []string) (map[string]string, error) {
+	vars := make(map[string]string, len(values))
+	for _, value := range values {
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || !templateVarNamePattern.MatchString(name) {
+			return nil, &cliError{fmt.Sprintf("invalid --set %q (expected NAME=VALUE with NAME made of letters, digits, and underscores)", value)}
+		}
+		vars[name] = val
+	}
+	return vars, nil
+}
+
+// expandTemplateVars replaces each ${NAME} in text with the --set value of NAME, falling back to
+// the environment variable NAME. Any variable that cannot be resolved is an error.
+func expandTemplateVars(text string, vars map[string]string) (string, error) {
+	var unresolved []string
+	expanded := templateVarPattern.ReplaceAllStringFunc(text, func(match string) string {
+		name := templateVarPattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if !slices.Contains(unresolved, name) {
+			unresolved = append(unresolved, name)
+		}
+		return match
+	})
+	if len(unresolved) > 0 {
+		return "", &inputError{fmt.Sprintf("unresolved system instruction template variables: %s (set them with --set NAME=VALUE or the environment)", strings.Join(unresolved, ", "))}
+	}
+	return expanded, nil
+}
+
+// renderPromptTemplate parses the STDIN content as JSON and renders the prompt template with it
+func renderPromptTemplate(templateText string, input []byte) (string, error) {
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(templateText)
+	if err != nil {
+		return "", &cliError{fmt.Sprintf("invalid --prompt-template: %v", err)}
+	}
+
+	// UseNumber keeps numeric fields rendering exactly as they appear in the input
+	var data interface{}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return "", &inputError{fmt.Sprintf("STDIN is not valid JSON for --prompt-template: %v", err)}
+	}
+	if decoder.More() {
+		return "", &inputError{"STDIN is not valid JSON for --prompt-template: unexpected data after JSON value"}
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", &inputError{fmt.Sprintf("failed to render --prompt-template: %v", err)}
+	}
+	return rendered.String(), nil
+}
+
+// Remote schemas fetched for $ref resolution, cached for the lifetime of the process
+var (
+	remoteSchemaCacheMu sync.Mutex
+	remoteSchemaCache   = map[string][]byte{}
+)
+
+// Maximum size of a remote schema document fetched for $ref resolution
+const maxRemoteSchemaBytes = 10 * 1024 * 1024
+
+// remoteSchemaLoader returns a jsonschema URL loader that fetches http and https references with the
+// connection settings of the API calls, caching each document, and defers to the default loader for
+// other schemes
+func remoteSchemaLoader(config *Config) func(string) (io.ReadCloser, error) {
+	return func(url string) (io.ReadCloser, error) {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return jsonschema.LoadURL(url)
+		}
+
+		remoteSchemaCacheMu.Lock()
+		defer remoteSchemaCacheMu.Unlock()
+		if content, ok := remoteSchemaCache[url]; ok {
+			return io.NopCloser(bytes.NewReader(content)), nil
+		}
+
+		resp, err := newHTTPClient(config).Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch remote schema %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch remote schema %s: status %d", url, resp.StatusCode)
+		}
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteSchemaBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote schema %s: %v", url, err)
+		}
+		if len(content) > maxRemoteSchemaBytes {
+			return nil, fmt.Errorf("remote schema %s exceeds %d bytes", url, maxRemoteSchemaBytes)
+		}
+
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Schema: fetched remote reference %s (%d bytes)\n", url, len(content))
+		}
+		remoteSchemaCache[url] = content
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+}
+
+// compiledSchema is a compiled validation schema along with its source for error attribution
+type compiledSchema struct {
+	Src    string
+	Schema *jsonschema.Schema
+	SHA256 string // Hash of the schema content for the audit log
+	// The schema compiled under the draft of --validate-only-against-draft, or nil
+	CrossCheck *jsonschema.Schema
+}
+
+// newSchemaCompiler returns a compiler for schemas that do not declare their draft in $schema
+func newSchemaCompiler(config *Config, draft *jsonschema.Draft) *jsonschema.Compiler {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = draft
+	if allowRemoteRefs {
+		compiler.LoadURL = remoteSchemaLoader(config)
+	}
+	return compiler
+}
+
+// compileSchema compiles a JSON Schema document for validating responses
+func compileSchema(config *Config, schemaBytes []byte) (*jsonschema.Schema, error) {
+	if config.SchemaCache != nil {
+		if compiled, ok := config.SchemaCache.get(schemaBytes); ok {
+			return compiled, nil
+		}
+	}
+
+	compiler := newSchemaCompiler(config, jsonschema.Draft2020)
+	if err := compiler.AddResource(schemaValidationURL, bytes.NewReader(schemaBytes)); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid JSON Schema: %v", err)}
+	}
+	compiled, err := compiler.Compile(schemaValidationURL)
+	if err != nil {
+		if !allowRemoteRefs && strings.Contains(err.Error(), "no Loader found for http") {
+			return nil, &inputError{fmt.Sprintf("invalid JSON Schema structure: %v (use --allow-remote-refs to resolve remote references)", err)}
+		}
+		return nil, &inputError{fmt.Sprintf("invalid JSON Schema structure: %v", err)}
+	}
+	if config.SchemaCache != nil {
+		config.SchemaCache.put(schemaBytes, compiled)
+	}
+	return compiled, nil
+}
+
+// readEnvContent returns the value of the environment variable named by an --*-env flag. An unset
+// variable is an error so that a misspelled name is not mistaken for empty content.
+func readEnvContent(flagName, name string) (string, error) {
+	content, ok := os.LookupEnv(name)
+	if !ok {
+		return "", &inputError{fmt.Sprintf("environment variable %s named by --%s is not set", name, flagName)}
+	}
+	return content, nil
+}
+
+// selectSchemaFile reads the schema files and returns the path and content of the one named by
+// selectName. A schema is named by its top-level $id, or by its file name without extension when
+// it has no $id. With a single file and no selection the file is returned as is.
+func selectSchemaFile(paths []string, selectName string) (string, []byte, error) {
+	var names []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", nil, &inputError{fmt.Sprintf("failed to read schema file: %v", err)}
+		}
+		if selectName == "" {
+			return path, content, nil
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		var header struct {
+			ID string `json:"$id"`
+		}
+		if lenientSchemaJSON {
+			content = relaxJSON(content)
+		}
+		if err := json.Unmarshal(content, &header); err != nil {
+			return "", nil, &inputError{fmt.Sprintf("invalid JSON in schema file %s: %v", path, err)}
+		}
+		if header.ID != "" {
+			name = header.ID
+		}
+
+		if name == selectName {
+			return path, content, nil
+		}
+		names = append(names, name)
+	}
+	return "", nil, &cliError{fmt.Sprintf("no schema named %q (available: %s)", selectName, strings.Join(names, ", "))}
+}
+
+// getIntConfigValue returns the flag value when the flag was set on the command line, otherwise the
+// first environment variable that is set, otherwise the flag's default value
+func getIntConfigValue(flagName string, flagValue int, envVars ...string) (int, error) {
+	if isFlagSet(flagName) {
+		return flagValue, nil
+	}
+	for _, envVar := range envVars {
+		if val := os.Getenv(envVar); val != "" {
+			parsed, err := strconv.Atoi(strings.TrimSpace(val))
+			if err != nil {
+				return 0, &cliError{fmt.Sprintf("invalid %s (expected an integer): %s", envVar, val)}
+			}
+			return parsed, nil
+		}
+	}
+	return flagValue, nil
+}
+
+// isFlagSet reports whether the named flag was explicitly provided on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveConfigValue returns the flag value when it is set, otherwise the value of the environment
+// variables. Several of them set to different values are ambiguous, so instead of one silently
+// taking precedence this is a usage error naming both; the flag resolves it.
+func resolveConfigValue(flagName, flagValue string, envVars ...string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	value, source := "", ""
+	for _, envVar := range envVars {
+		val := os.Getenv(envVar)
+		if val == "" {
+			continue
+		}
+		if source == "" {
+			value, source = val, envVar
+		} else if val != value {
+			return "", &cliError{fmt.Sprintf("ambiguous --%s: %s=%s and %s=%s disagree; set --%s to choose", flagName, source, value, envVar, val, flagName)}
+		}
+	}
+	return value, nil
+}
+
+// firstSetFlag returns the name of the first flag with a value, given as name and value pairs, or
+// "" when none is set, so that a conflict names the source actually given
+func firstSetFlag(namesAndValues ...string) string {
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		if namesAndValues[i+1] != "" {
+			return namesAndValues[i]
+		}
+	}
+	return ""
+}
+
+func getConfigValue(flagValue string, envVars ...string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	for _, envVar := range envVars {
+		if val := os.Getenv(envVar); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+func loadAttachments(config *Config) ([]interface{}, error) {
+	var parts []interface{}
+	var totalRawBytes int64
+	var totalEncodedBytes int64
+	seen := map[string]string{} // Content hash to the first attachment with that content
+
+	if len(attachments) == 0 && config.RequireAttachments {
+		return nil, &inputError{"no attachments given, but --require-attachments is set"}
+	}
+
+	// Checked before anything is read, so a runaway list fails without reading or downloading files
+	if len(attachments) > config.MaxAttachments {
+		return nil, &inputError{fmt.Sprintf("%d attachments exceed --max-attachments %d", len(attachments), config.MaxAttachments)}
+	}
+
+	for i, path := range attachments {
+		// Determine MIME type from extension, or from --attach-type for STDIN
+		ext := strings.ToLower(filepath.Ext(path))
+		if path == stdinPath {
+			ext = "." + config.AttachType
+		}
+		var mimeType string
+		var isImage bool
+		switch ext {
+		case ".png":
+			mimeType = "image/png"
+			isImage = true
+		case ".jpg", ".jpeg":
+			mimeType = "image/jpeg"
+			isImage = true
+		case ".webp":
+			mimeType = "image/webp"
+			isImage = true
+		case ".pdf":
+			mimeType = "application/pdf"
+			isImage = false
+		default:
+			return nil, &inputError{fmt.Sprintf("unsupported attachment type: %s (supported: .png, .jpg, .jpeg, .webp, .pdf)", ext)}
+		}
+
+		// Read and encode file
+		var content []byte
+		var err error
+		if path == stdinPath {
+			path = "stdin"
+			content, err = io.ReadAll(os.Stdin)
+		} else if strings.HasPrefix(path, gcsURIPrefix) {
+			// Bytes are downloaded and inlined, so no more than the inline limits are read
+			var limit int64 = maxTotalSizeBytes
+			if isImage {
+				limit = maxImageSizeBytes
+			} else if config.PDFChunkPages > 0 {
+				limit = 0
+			}
+			if content, err = downloadGCSObject(config, path, limit); err != nil {
+				return nil, err
+			}
+		} else {
+			content, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to read attachment %s: %v", path, err)}
+		}
+
+		// Validate image file size (7 MB limit before base64 encoding)
+		if isImage && len(content) > maxImageSizeBytes {
+			sizeMB := float64(len(content)) / (1024 * 1024)
+			return nil, &inputError{fmt.Sprintf("image file %s exceeds 7 MB limit: %.2f MB (Gemini API limits image files to 7 MB before base64 encoding)", path, sizeMB)}
+		}
+
+		digest := sha256Hex(content)
+		if first, duplicate := seen[digest]; duplicate && config.DedupAttachments {
+			if config.Verbosity >= verbosityConfig {
+				config.Log.Printf("Attachment: %s skipped, same content as %s\n", path, first)
+			}
+			continue
+		}
+		seen[digest] = path
+		config.AttachmentDigests = append(config.AttachmentDigests, attachmentDigest{Name: path, SHA256: digest})
+
+		// A labeled attachment is introduced by a text part naming it, which helps the model tell
+		// several attachments apart
+		if i < len(config.AttachmentLabels) && config.AttachmentLabels[i] != "" {
+			parts = append(parts, map[string]interface{}{"text": "Attachment: " + config.AttachmentLabels[i]})
+			if config.Verbosity >= verbosityConfig {
+				config.Log.Printf("Attachment: %s labeled %q\n", path, config.AttachmentLabels[i])
+			}
+		}
+
+		// A chunked PDF is sent one chunk per request, so only the largest chunk counts toward the limit
+		if mimeType == "application/pdf" && config.PDFChunkPages > 0 {
+			chunks, pageCount, err := splitPDF(content, config.PDFChunkPages)
+			if err != nil {
+				return nil, &inputError{fmt.Sprintf("failed to split PDF %s: %v", path, err)}
+			}
+			var largestChunk int64
+			for _, chunk := range chunks {
+				encodedChunk := base64.StdEncoding.EncodeToString(chunk)
+				if int64(len(encodedChunk)) > largestChunk {
+					largestChunk = int64(len(encodedChunk))
+				}
+				config.PDFChunkParts = append(config.PDFChunkParts, map[string]interface{}{
+					"inlineData": map[string]interface{}{
+						"mimeType": mimeType,
+						"data":     encodedChunk,
+					},
+				})
+			}
+			config.PDFChunkIndex = len(parts)
+			totalRawBytes += int64(len(content))
+			totalEncodedBytes += largestChunk
+			if config.Verbosity >= verbosityConfig {
+				config.Log.Printf("Attachment: %s (%s, %d bytes, %d pages in %d chunks of up to %d pages)\n",
+					path, mimeType, len(content), pageCount, len(chunks), config.PDFChunkPages)
+			}
+			continue
+		}
+
+		encodedData := base64.StdEncoding.EncodeToString(content)
+		totalRawBytes += int64(len(content))
+		totalEncodedBytes += int64(len(encodedData))
+
+		part := map[string]interface{}{
+			"inlineData": map[string]interface{}{
+				"mimeType": mimeType,
+				"data":     encodedData,
+			},
+		}
+		parts = append(parts, part)
+
+		if config.Verbosity >= verbosityConfig {
+			if isImage {
+				sizeMB := float64(len(content)) / (1024 * 1024)
+				config.Log.Printf("Attachment: %s (%s, %.2f MB) - within size limits\n", path, mimeType, sizeMB)
+			} else {
+				config.Log.Printf("Attachment: %s (%s, %d bytes)\n", path, mimeType, len(content))
+			}
+		}
+	}
+
+	// Validate total attachment size doesn't approach the 20 MB request limit
+	const maxAttachmentBytes = 20 * 1024 * 1024
+	if totalEncodedBytes > maxAttachmentBytes {
+		totalMB := float64(totalEncodedBytes) / (1024 * 1024)
+		return nil, &inputError{fmt.Sprintf("total attachment size exceeds limit: %.2f MB encoded (limit 20 MB)", totalMB)}
+	}
+
+	if len(attachments) > 0 && config.Verbosity >= verbosityConfig {
+		totalMB := float64(totalEncodedBytes) / (1024 * 1024)
+		config.Log.Printf("Total attachments: %d files, %.2f MB (encoded) - within limits\n", len(attachments), totalMB)
+	}
+
+	return parts, nil
+}
+
+// splitAttachmentLabel splits an --attach argument of the form PATH#LABEL into the path and the
+// label. An argument that names an existing local file is a path as a whole, so that files whose
+// names contain # attach as before; a trailing # with no label also leaves the path unlabeled.
+func splitAttachmentLabel(arg string) (string, string) {
+	i := strings.LastIndex(arg, "#")
+	if i < 0 {
+		return arg, ""
+	}
+	if !strings.HasPrefix(arg, gcsURIPrefix) {
+		if _, err := os.Stat(arg); err == nil {
+			return arg, ""
+		}
+	}
+	return arg[:i], strings.TrimSpace(arg[i+1:])
+}
+
+// buildResponseSchema returns the schema sent as responseJsonSchema: the generation schema when
+// provided, otherwise the validation schema, with propertyOrdering added or value constraints
+// removed when those modes are active
+func buildResponseSchema(config *Config) (map[string]interface{}, error) {
+	responseSchema := config.Schema
+	if config.GenSchema != nil {
+		responseSchema = config.GenSchema
+	}
+	if config.PropertyOrdering {
+		// The parsed schema has lost the declaration order, so it is derived from the original bytes
+		ordered, err := withPropertyOrdering(config.SentSchemaBytes)
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to derive propertyOrdering from schema: %v", err)}
+		}
+		responseSchema = ordered
+	}
+	if config.Degraded {
+		responseSchema = degradeSchema(responseSchema)
+	}
+	return responseSchema, nil
+}
+
+// Keywords that describe a schema without constraining the response
+var annotationKeywords = []string{"title", "description", "examples", "example", "$comment"}
+
+// warnLargeSchema logs a warning when the schema as sent in responseJsonSchema is larger than
+// limit bytes, with the share of it taken up by annotations, which a --gen-schema-file without them
+// would save on every request
+func warnLargeSchema(config *Config, limit int) error {
+	responseSchema, err := buildResponseSchema(config)
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(responseSchema)
+	if err != nil {
+		return &inputError{fmt.Sprintf("failed to marshal schema: %v", err)}
+	}
+	if len(serialized) <= limit {
+		return nil
+	}
+
+	var annotationBytes int
+	walkSchema(responseSchema, "", func(schema map[string]interface{}, _ string) {
+		for _, keyword := range annotationKeywords {
+			if value, ok := schema[keyword]; ok {
+				encoded, _ := json.Marshal(map[string]interface{}{keyword: value})
+				annotationBytes += len(encoded) - 1 // Outer braces, less the comma that separates members
+			}
+		}
+	})
+	warnAdvisory(config, warningLargeSchema, "schema sent to the API is %d bytes, more than --warn-schema-bytes %d; %d bytes (%.0f%%) are annotations (%s) that a --gen-schema-file without them would not send\n",
+		len(serialized), limit, annotationBytes, 100*float64(annotationBytes)/float64(len(serialized)), strings.Join(annotationKeywords, ", "))
+	return nil
+}
+
+// requestHash returns the SHA-256 of the RFC 8785 canonical JSON of {"model": model, "request":
+// requestBody}. The model is included since the body does not name it, and canonicalizing makes the
+// hash independent of how the body happens to be serialized.
+func requestHash(model string, requestBody []byte) (string, error) {
+	var request interface{}
+	if err := json.Unmarshal(requestBody, &request); err != nil {
+		return "", &inputError{fmt.Sprintf("failed to parse request body: %v", err)}
+	}
+	canonical, err := canonicalJSON(map[string]interface{}{"model": model, "request": request})
+	if err != nil {
+		return "", &inputError{fmt.Sprintf("failed to canonicalize request body: %v", err)}
+	}
+	return sha256Hex(canonical), nil
+}
+
+func buildGeminiRequest(config *Config, attachmentParts []interface{}) ([]byte, error) {
+	// Build parts array with prompt text and attachments, or in the order of --parts-file
+	var contentParts []interface{}
+	if config.PromptParts != nil {
+		contentParts = buildPromptParts(config.PromptParts, attachmentParts)
+	} else {
+		textPart := map[string]interface{}{
+			"text": config.Prompt,
+		}
+		if config.AttachmentsFirst {
+			contentParts = append(append(contentParts, attachmentParts...), textPart)
+		} else {
+			contentParts = append([]interface{}{textPart}, attachmentParts...)
+		}
+	}
+
+	// A unique trailing part makes each request distinct, so no cached or deduplicated response
+	// can be returned for it
+	if config.NoCachePrompt {
+		nonce, err := newRequestID()
+		if err != nil {
+			return nil, &inputError{fmt.Sprintf("failed to generate prompt nonce: %v", err)}
+		}
+		contentParts = append(contentParts, map[string]interface{}{
+			"text": fmt.Sprintf(promptNonceFormat, nonce),
+		})
+	}
+
+	responseSchema, err := buildResponseSchema(config)
+	if err != nil {
+		return nil, err
+	}
+
+	request := map[string]interface{}{
+		"systemInstruction": map[string]interface{}{
+			"parts": []interface{}{
+				map[string]interface{}{
+					"text": config.SystemInstruction,
+				},
+			},
+		},
+		"contents": []interface{}{
+			map[string]interface{}{
+				"role":  "user",
+				"parts": contentParts,
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"responseMimeType":   "application/json",
+			"responseJsonSchema": responseSchema,
+		},
+	}
+
+	generationConfig := request["generationConfig"].(map[string]interface{})
+	if config.Temperature != nil {
+		generationConfig["temperature"] = *config.Temperature
+	}
+	if config.TopK != nil {
+		generationConfig["topK"] = *config.TopK
+	}
+	if config.Seed != nil {
+		generationConfig["seed"] = *config.Seed
+	}
+	if config.CandidateCount > 0 {
+		generationConfig["candidateCount"] = config.CandidateCount
+	}
+
+	// Log probabilities are returned alongside the response and do not change the generated text
+	if config.Logprobs > 0 {
+		generationConfig["responseLogprobs"] = true
+		generationConfig["logprobs"] = config.Logprobs
+	}
+
+	// Grounding with Google Search is enabled by adding the googleSearch tool
+	if config.Grounding {
+		request["tools"] = []interface{}{
+			map[string]interface{}{
+				"googleSearch": map[string]interface{}{},
+			},
+		}
+	}
+
+	// The request is merged into the --request-template, keeping the fields that options do not expose
+	if config.RequestTemplate != nil {
+		if request, err = applyRequestTemplate(config.RequestTemplate, request); err != nil {
+			return nil, err
+		}
+	}
+
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to marshal request: %v", err)}
+	}
+
+	return requestBytes, nil
+}
+
+func buildGeminiURL(config *Config) string {
+	// For global region, use aiplatform.googleapis.com (no region prefix)
+	// For regional endpoints, use {region}-aiplatform.googleapis.com
+	var url string
+	if config.Location == "global" {
+		url = fmt.Sprintf("https://aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
+			config.Project, config.Location, config.Model)
+	} else {
+		url = fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
+			config.Location, config.Project, config.Location, config.Model)
+	}
+	return url
+}
+
+// callGeminiWithFailover calls the API in each configured location in turn, moving on to the next
+// location only when the previous one failed with a connection error or server error
+func callGeminiWithFailover(config *Config, requestBody []byte) (string, error) {
+	for i, loc := range config.Locations {
+		locationConfig := *config
+		locationConfig.Location = loc
+		responseJSON, err := callGeminiWithFallback(&locationConfig, requestBody)
+		if err == nil {
+			if config.Verbosity >= verbosityRequest && len(config.Locations) > 1 {
+				config.Log.Printf("API response: location=%s\n", loc)
+			}
+			return responseJSON, nil
+		}
+
+		apiErr, isAPIError := err.(*apiError)
+		if !isAPIError || !apiErr.retryable || i == len(config.Locations)-1 {
+			return responseJSON, err
 		}
+		config.Log.Printf("Location %s failed (%v); trying location %s\n", loc, err, config.Locations[i+1])
 	}
+	return "", &cliError{"no location configured"}
+}
 
-	// Compile the JSON Schema once for reuse
-	compiler := jsonschema.NewCompiler()
-	compiler.Draft = jsonschema.Draft2020
-	if err := compiler.AddResource(schemaValidationURL, bytes.NewReader(schemaBytes)); err != nil {
-		return nil, &inputError{fmt.Sprintf("invalid JSON Schema: %v", err)}
+// callGeminiWithFallback calls the API with the configured model and, when that model is
+// quota-throttled and a fallback model is configured, retries the same request with the fallback.
+// Quota errors on the primary model switch to the fallback immediately instead of backing off.
+func callGeminiWithFallback(config *Config, requestBody []byte) (string, error) {
+	responseJSON, err := callGeminiWithRetry(config, requestBody, config.FallbackModel == "")
+	if _, isQuota := err.(*quotaError); !isQuota || config.FallbackModel == "" {
+		return responseJSON, err
+	}
+
+	config.Log.Printf("Quota exceeded for model %s; retrying with fallback model %s\n", config.Model, config.FallbackModel)
+	fallbackConfig := *config
+	fallbackConfig.Model = config.FallbackModel
+	return callGeminiWithRetry(&fallbackConfig, requestBody, true)
+}
+
+// callGeminiWithRetry calls the API, retrying transient failures up to config.MaxRetries times with
+// exponential backoff and the --retry-jitter strategy. A quota error's Retry-After delay is honored
+// when it is longer than the backoff.
+func callGeminiWithRetry(config *Config, requestBody []byte, retryQuota bool) (string, error) {
+	for attempt := 0; ; attempt++ {
+		responseJSON, err := callGeminiAPI(config, requestBody)
+		if err == nil || attempt >= config.MaxRetries {
+			return responseJSON, err
+		}
+
+		delay := config.RetryBackoff.delay(attempt)
+		switch e := err.(type) {
+		case *apiError:
+			if !e.retryable {
+				return responseJSON, err
+			}
+		case *quotaError:
+			if !retryQuota {
+				return responseJSON, err
+			}
+			if e.retryAfter > delay {
+				delay = e.retryAfter
+			}
+		default:
+			return responseJSON, err
+		}
+
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Retry: attempt %d of %d failed (%v); retrying in %s\n", attempt+1, config.MaxRetries+1, err, delay)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// logTimeBudget logs the longest time a single generation can take given --timeout, --max-retries,
+// and the retry backoff, counting every location, the fallback model, and --degrade-schema or
+// --retry-on-validation retries. A Retry-After delay longer than the backoff can extend it.
+func logTimeBudget(config *Config) {
+	if config.Timeout == 0 {
+		config.Log.Printf("Time budget: unbounded (--timeout 0 disables the request timeout)\n")
+		return
+	}
+
+	attempts := config.MaxRetries + 1
+	var backoff time.Duration
+	for attempt := 0; attempt < config.MaxRetries; attempt++ {
+		backoff += backoffCap(attempt)
+	}
+	perModel := time.Duration(attempts)*time.Duration(config.Timeout)*time.Second + backoff
+
+	calls := len(config.Locations)
+	if config.FallbackModel != "" {
+		calls *= 2
 	}
-	compiledSchema, err := compiler.Compile(schemaValidationURL)
+	if config.DegradeAfter > 0 {
+		calls *= config.DegradeAfter + 1
+	}
+	calls *= config.RetryOnValidation + 1
+	detail := fmt.Sprintf("%d attempts of up to %ds plus %s backoff", attempts, config.Timeout, backoff)
+	if calls > 1 {
+		detail += fmt.Sprintf(", %d times over for locations, fallback model, and validation retries", calls)
+	}
+	config.Log.Printf("Time budget: worst case %s per generation (%s)\n", perModel*time.Duration(calls), detail)
+}
+
+func callGeminiAPI(config *Config, requestBody []byte) (text string, err error) {
+	defer func() {
+		err = withRequestID(err, config.RequestID)
+	}()
+
+	start := time.Now()
+	respBody, err := postVertexAI(config, buildGeminiURL(config), requestBody)
+	config.Metrics.addRequest(time.Since(start))
 	if err != nil {
-		return nil, &inputError{fmt.Sprintf("invalid JSON Schema structure: %v", err)}
+		return "", err
 	}
-	config.CompiledSchema = compiledSchema
 
-	if verbose {
-		fmt.Fprintf(os.Stderr, "Schema validation: compiled successfully\n")
+	// Parse response, which some endpoint variants return in a different top-level shape
+	geminiResp, shape, err := decodeGeminiResponse(respBody)
+	if err != nil {
+		return "", &validationError{err.Error()}
+	}
+	if shape != responseShapeStandard && config.Verbosity >= verbosityRequest {
+		config.Log.Printf("API response: decoded the alternate response shape %s\n", shape)
 	}
 
-	// Load prompt
-	if prompt != "" && promptFile != "" {
-		return nil, &cliError{"cannot specify both --prompt and --prompt-file"}
+	if len(geminiResp.Candidates) == 0 {
+		return "", &validationError{"no candidates in response"}
 	}
 
-	if prompt != "" {
-		config.Prompt = strings.TrimSpace(prompt)
-		config.PromptSrc = "flag"
-	} else if promptFile != "" {
-		content, err := os.ReadFile(promptFile)
-		if err != nil {
-			return nil, &inputError{fmt.Sprintf("failed to read prompt file: %v", err)}
+	candidate := geminiResp.Candidates[0]
+
+	// Check finish reason; a response cut off at the output token limit is reported as truncation and
+	// is only passed on to validation with --accept-truncated
+	truncated := candidate.FinishReason == "MAX_TOKENS"
+	if truncated {
+		if config.AcceptTruncated {
+			config.Log.Printf("Warning: response truncated at the output token limit (finishReason=MAX_TOKENS); accepting it only if it passes validation\n")
+		} else {
+			config.Log.Printf("Warning: response truncated at the output token limit (finishReason=MAX_TOKENS)\n")
+			return "", &validationError{"response was truncated at the output token limit (finishReason=MAX_TOKENS); raise the model's output token limit or use --accept-truncated to accept a partial response that still validates"}
 		}
-		config.Prompt = strings.TrimSpace(string(content))
-		config.PromptSrc = promptFile
-	} else {
-		// Read from STDIN
-		content, err := io.ReadAll(os.Stdin)
-		if err != nil {
-			return nil, &inputError{fmt.Sprintf("failed to read from STDIN: %v", err)}
+	} else if slices.Contains(config.AcceptFinishReasons, candidate.FinishReason) {
+		config.Log.Printf("Warning: generation stopped with finishReason=%s; accepting it only if it passes validation\n", candidate.FinishReason)
+	} else if candidate.FinishReason != "STOP" {
+		// Include finishMessage in error for better diagnostics
+		errorMsg := fmt.Sprintf("unexpected finish reason: %s", candidate.FinishReason)
+		if candidate.FinishMessage != "" {
+			errorMsg = fmt.Sprintf("%s (finishMessage: %s)", errorMsg, candidate.FinishMessage)
+			// Log finishMessage to STDERR even when not in verbose mode
+			config.Log.Printf("Generation stopped: finishReason=%s, finishMessage=%s\n", candidate.FinishReason, candidate.FinishMessage)
+		} else {
+			config.Log.Printf("Generation stopped: finishReason=%s\n", candidate.FinishReason)
 		}
-		config.Prompt = strings.TrimSpace(string(content))
-		config.PromptSrc = "stdin"
+		if !slices.Contains(knownFinishReasons, candidate.FinishReason) {
+			// Newer models can report reasons added to the API since this version was released
+			config.Log.Printf("Warning: unrecognized finishReason=%s; please report it so that it can be handled\n", candidate.FinishReason)
+			if config.RetryUnknownFinish {
+				return "", &apiError{message: errorMsg, retryable: true}
+			}
+		}
+		return "", &validationError{errorMsg}
 	}
 
-	if config.Prompt == "" {
-		return nil, &inputError{"prompt cannot be empty"}
+	if len(candidate.Content.Parts) == 0 {
+		if truncated {
+			return "", &validationError{"response was truncated at the output token limit (finishReason=MAX_TOKENS) before any content was generated"}
+		}
+		return "", &validationError{"no content parts in response"}
 	}
 
-	if verbose {
-		switch config.PromptSrc {
-		case "stdin":
-			fmt.Fprintf(os.Stderr, "Prompt: %d bytes (from stdin)\n", len(config.Prompt))
-		case "flag":
-			fmt.Fprintf(os.Stderr, "Prompt: %d bytes (from flag)\n", len(config.Prompt))
-		default:
-			fmt.Fprintf(os.Stderr, "Prompt: %d bytes (from %s)\n", len(config.Prompt), config.PromptSrc)
+	// Concatenate all parts[].text in order
+	var jsonTextBuilder strings.Builder
+	for _, part := range candidate.Content.Parts {
+		jsonTextBuilder.WriteString(part.Text)
+	}
+	jsonText := jsonTextBuilder.String()
+
+	if jsonText == "" {
+		return "", &validationError{"empty response text"}
+	}
+
+	config.Usage.add(geminiResp.UsageMetadata.PromptTokenCount, geminiResp.UsageMetadata.CandidatesTokenCount, geminiResp.UsageMetadata.TotalTokenCount)
+	config.Usage.addModelVersion(geminiResp.ModelVersion)
+
+	// Log the response metadata and token usage, and the raw response text at the highest verbosity
+	if config.Verbosity >= verbosityRequest {
+		if geminiResp.ModelVersion != "" {
+			config.Log.Printf("API response: finish_reason=%s model_version=%s\n", candidate.FinishReason, geminiResp.ModelVersion)
+		} else {
+			config.Log.Printf("API response: finish_reason=%s\n", candidate.FinishReason)
+		}
+	}
+	if config.Verbosity >= verbosityDetail {
+		if config.FullRaw || len(jsonText) <= rawTextLogLimit {
+			config.Log.Printf("Raw response text (%d bytes):\n%s\n", len(jsonText), jsonText)
+		} else {
+			cut := rawTextLogLimit
+			for cut > 0 && !utf8.RuneStart(jsonText[cut]) {
+				cut--
+			}
+			config.Log.Printf("Raw response text (%d bytes, first %d shown; use --full-raw for all):\n%s\n", len(jsonText), cut, jsonText[:cut])
+		}
+	}
+	if config.Verbosity >= verbosityRequest {
+		if geminiResp.UsageMetadata.TotalTokenCount > 0 {
+			config.Log.Printf("Token usage:\n  promptTokenCount:     %d\n  candidatesTokenCount: %d\n  totalTokenCount:      %d\n",
+				geminiResp.UsageMetadata.PromptTokenCount, geminiResp.UsageMetadata.CandidatesTokenCount, geminiResp.UsageMetadata.TotalTokenCount)
 		}
 	}
 
-	// Load project, location, model with environment fallback
-	config.Project = getConfigValue(projectFlag, "GOOGLE_CLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT")
-	if config.Project == "" {
-		return nil, &cliError{"--project is required (or set GOOGLE_CLOUD_PROJECT)"}
+	if config.Grounding {
+		if err := reportGroundingMetadata(config, candidate.GroundingMetadata); err != nil {
+			return "", err
+		}
 	}
 
-	// Validate project ID
-	if !project.IsValidProjectID(config.Project) {
-		return nil, &inputError{fmt.Sprintf("invalid GCP project ID: %s", config.Project)}
+	if config.LogprobsFile != "" {
+		if err := writeLogprobsFile(config, candidate.LogprobsResult); err != nil {
+			return "", err
+		}
 	}
 
-	config.Location = getConfigValue(locationFlag, "GOOGLE_CLOUD_LOCATION", "GOOGLE_CLOUD_REGION", "CLOUDSDK_COMPUTE_REGION")
-	if config.Location == "" {
-		return nil, &cliError{"--location is required (or set GOOGLE_CLOUD_LOCATION)"}
+	// Text around the JSON value is dropped; without a value the text is left for validation to reject
+	if config.ExtractFirstJSON {
+		if start, end, ok := extractFirstJSON(jsonText); ok {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Extract: first JSON value at bytes %d-%d of %d\n", start, end, len(jsonText))
+			}
+			jsonText = jsonText[start:end]
+		} else if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Extract: no balanced JSON object or array found in %d bytes\n", len(jsonText))
+		}
 	}
 
-	// Validate region (allow "global" for Vertex AI models that are only available globally)
-	if config.Location != "global" && !location.IsValidRegion(config.Location) {
-		return nil, &inputError{fmt.Sprintf("invalid GCP region: %s", config.Location)}
+	return jsonText, nil
+}
+
+// writeLogprobsFile writes the raw logprobsResult of the response to the sidecar file
+func writeLogprobsFile(config *Config, rawLogprobs json.RawMessage) error {
+	if len(rawLogprobs) == 0 || string(rawLogprobs) == "null" {
+		config.Log.Printf("Warning: response did not include log probabilities\n")
+		rawLogprobs = json.RawMessage("{}")
 	}
 
-	config.Model = getConfigValue(modelFlag)
-	if config.Model == "" {
-		return nil, &cliError{"--model is required"}
+	var prettyBuf bytes.Buffer
+	if err := json.Indent(&prettyBuf, rawLogprobs, "", "  "); err != nil {
+		return &validationError{fmt.Sprintf("failed to format log probabilities: %v", err)}
+	}
+	if err := os.WriteFile(config.LogprobsFile, prettyBuf.Bytes(), 0644); err != nil {
+		return &inputError{fmt.Sprintf("failed to write logprobs file: %v", err)}
 	}
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Log probabilities written to: %s\n", config.LogprobsFile)
+	}
+	return nil
+}
 
-	// Validate model name
-	if !vertexai.IsValidVertexModelName(config.Model) {
-		return nil, &inputError{fmt.Sprintf("invalid Vertex AI model name: %s", config.Model)}
+// postVertexAI sends an authenticated POST request with a JSON body to a Vertex AI endpoint and
+// returns the response body of a successful call. Failures are classified as authentication,
+// quota, or (possibly retryable) API errors.
+func postVertexAI(config *Config, url string, requestBody []byte) ([]byte, error) {
+	session := config.Session
+	if session == nil {
+		var err error
+		if session, err = newAPISession(config); err != nil {
+			return nil, err
+		}
 	}
+	client, ctx := session.client, session.ctx
 
-	// Validate timeout
-	if timeout < 0 {
-		return nil, &cliError{"--timeout must be non-negative"}
+	token, err := fetchToken(config, session)
+	if err != nil {
+		return nil, err
 	}
-	config.Timeout = timeout
 
-	if verbose {
-		fmt.Fprintf(os.Stderr, "API configuration: project=%s location=%s model=%s\n", config.Project, config.Location, config.Model)
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Request: POST %s\n", url)
 	}
 
-	return config, nil
-}
+	// Create request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, &apiError{message: fmt.Sprintf("failed to create request: %v", err)}
+	}
 
-func getConfigValue(flagValue string, envVars ...string) string {
-	if flagValue != "" {
-		return flagValue
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	req.Header.Set("X-Request-Id", config.RequestID)
+	if config.QuotaProject != "" {
+		req.Header.Set("X-Goog-User-Project", config.QuotaProject)
 	}
-	for _, envVar := range envVars {
-		if val := os.Getenv(envVar); val != "" {
-			return val
+
+	// Send request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &apiError{message: fmt.Sprintf("failed to call API: %v", err), retryable: true}
+	}
+	defer resp.Body.Close()
+
+	// Read response, reading one byte past the limit to detect a response that exceeds it
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, config.MaxResponseBytes+1))
+	if err != nil {
+		return nil, &apiError{message: fmt.Sprintf("failed to read response: %v", err), retryable: true}
+	}
+	if int64(len(respBody)) > config.MaxResponseBytes {
+		return nil, &apiError{message: fmt.Sprintf("API response exceeds --max-response-bytes %d (status %d)", config.MaxResponseBytes, resp.StatusCode)}
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, &authError{fmt.Sprintf("API returned status %d: %s (%s)", resp.StatusCode, string(respBody), authErrorHint)}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode != http.StatusOK && bytes.Contains(respBody, []byte("RESOURCE_EXHAUSTED"))) {
+		retryAfter, hasRetryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		message := fmt.Sprintf("API quota exceeded (status %d): %s", resp.StatusCode, string(respBody))
+		if hasRetryAfter {
+			message = fmt.Sprintf("API quota exceeded (status %d, retry after %s): %s", resp.StatusCode, retryAfter, string(respBody))
 		}
+		return nil, &quotaError{message: message, retryAfter: retryAfter}
 	}
-	return ""
+
+	if resp.StatusCode != http.StatusOK {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout
+		return nil, &apiError{message: fmt.Sprintf("API returned status %d: %s", resp.StatusCode, string(respBody)), retryable: retryable}
+	}
+
+	// A proxy or captive portal can answer with an HTML page and status 200, which would otherwise
+	// surface as a confusing JSON parse error
+	if config.StrictContentType {
+		contentType := resp.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return nil, &apiError{message: fmt.Sprintf("API returned Content-Type %q instead of JSON (status %d), possibly from a proxy; response begins: %s",
+				contentType, resp.StatusCode, responseSnippet(respBody))}
+		}
+	}
+
+	return respBody, nil
 }
 
-func loadAttachments(config *Config) ([]interface{}, error) {
-	var parts []interface{}
-	var totalRawBytes int64
-	var totalEncodedBytes int64
+// Most bytes of a response body quoted by responseSnippet
+const responseSnippetLimit = 200
 
-	for _, path := range attachments {
-		// Determine MIME type from extension
-		ext := strings.ToLower(filepath.Ext(path))
-		var mimeType string
-		var isImage bool
-		switch ext {
-		case ".png":
-			mimeType = "image/png"
-			isImage = true
-		case ".jpg", ".jpeg":
-			mimeType = "image/jpeg"
-			isImage = true
-		case ".webp":
-			mimeType = "image/webp"
-			isImage = true
-		case ".pdf":
-			mimeType = "application/pdf"
-			isImage = false
-		default:
-			return nil, &inputError{fmt.Sprintf("unsupported attachment type: %s (supported: .png, .jpg, .jpeg, .webp, .pdf)", ext)}
+// responseSnippet returns the start of a response body on a single line, for error messages
+func responseSnippet(body []byte) string {
+	snippet := body
+	if len(snippet) > responseSnippetLimit {
+		cut := responseSnippetLimit
+		for cut > 0 && !utf8.RuneStart(snippet[cut]) {
+			cut--
 		}
+		snippet = snippet[:cut]
+	}
+	text := strings.Join(strings.Fields(string(snippet)), " ")
+	if len(snippet) < len(body) {
+		text += " ..."
+	}
+	return text
+}
 
-		// Read and encode file
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return nil, &inputError{fmt.Sprintf("failed to read attachment %s: %v", path, err)}
+// reportGroundingMetadata logs the grounding search queries and sources in verbose mode
+// and writes the raw grounding metadata to the sidecar file when one is configured
+func reportGroundingMetadata(config *Config, rawMetadata json.RawMessage) error {
+	if len(rawMetadata) == 0 || string(rawMetadata) == "null" {
+		rawMetadata = json.RawMessage("{}")
+	}
+
+	if config.Verbosity >= verbosityRequest {
+		var metadata struct {
+			WebSearchQueries []string `json:"webSearchQueries"`
+			GroundingChunks  []struct {
+				Web struct {
+					URI   string `json:"uri"`
+					Title string `json:"title"`
+				} `json:"web"`
+			} `json:"groundingChunks"`
+		}
+		if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+			config.Log.Printf("Grounding: failed to parse grounding metadata: %v\n", err)
+		} else {
+			var summary strings.Builder
+			fmt.Fprintf(&summary, "Grounding: %d search queries, %d sources\n", len(metadata.WebSearchQueries), len(metadata.GroundingChunks))
+			for _, query := range metadata.WebSearchQueries {
+				fmt.Fprintf(&summary, "  query:  %s\n", query)
+			}
+			for _, chunk := range metadata.GroundingChunks {
+				fmt.Fprintf(&summary, "  source: %s (%s)\n", chunk.Web.Title, chunk.Web.URI)
+			}
+			config.Log.Printf("%s", summary.String())
 		}
+	}
 
-		// Validate image file size (7 MB limit before base64 encoding)
-		if isImage && len(content) > maxImageSizeBytes {
-			sizeMB := float64(len(content)) / (1024 * 1024)
-			return nil, &inputError{fmt.Sprintf("image file %s exceeds 7 MB limit: %.2f MB (Gemini API limits image files to 7 MB before base64 encoding)", path, sizeMB)}
+	if config.GroundingFile != "" {
+		var prettyBuf bytes.Buffer
+		if err := json.Indent(&prettyBuf, rawMetadata, "", "  "); err != nil {
+			return &validationError{fmt.Sprintf("failed to format grounding metadata: %v", err)}
+		}
+		if err := os.WriteFile(config.GroundingFile, prettyBuf.Bytes(), 0644); err != nil {
+			return &inputError{fmt.Sprintf("failed to write grounding file: %v", err)}
 		}
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Grounding metadata written to: %s\n", config.GroundingFile)
+		}
+	}
 
-		encodedData := base64.StdEncoding.EncodeToString(content)
-		totalRawBytes += int64(len(content))
-		totalEncodedBytes += int64(len(encodedData))
+	return nil
+}
 
-		part := map[string]interface{}{
-			"inlineData": map[string]interface{}{
-				"mimeType": mimeType,
-				"data":     encodedData,
-			},
+// apiSession is the HTTP client and credentials used to call the API. A session shared across
+// requests keeps connections alive and caches the access token until it expires.
+type apiSession struct {
+	client      *http.Client
+	ctx         context.Context
+	tokenSource oauth2.TokenSource
+}
+
+func newAPISession(config *Config) (*apiSession, error) {
+	// The same client is used to fetch the access token so both connections honor --prefer-ipv4
+	client := newHTTPClient(config)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+
+	session := &apiSession{client: client, ctx: ctx}
+	switch config.CredentialsSource {
+	case credentialsSourceMetadata:
+		// GOOGLE_APPLICATION_CREDENTIALS and gcloud credentials are never consulted
+		if !metadata.OnGCE() {
+			return nil, &authError{"failed to get credentials: the metadata server is not available (--credentials-source metadata requires running on GCE, GKE, or another Google Cloud runtime)"}
 		}
-		parts = append(parts, part)
+		session.tokenSource = google.ComputeTokenSource("", config.Scopes...)
+	case credentialsSourceFile:
+		content, err := os.ReadFile(config.CredentialsFile)
+		if err != nil {
+			return nil, &authError{fmt.Sprintf("failed to read credentials file: %v", err)}
+		}
+		creds, err := google.CredentialsFromJSON(ctx, content, config.Scopes...)
+		if err != nil {
+			return nil, &authError{fmt.Sprintf("failed to get credentials from %s: %v (%s)", config.CredentialsFile, err, authErrorHint)}
+		}
+		session.tokenSource = creds.TokenSource
+	default:
+		creds, err := google.FindDefaultCredentials(ctx, config.Scopes...)
+		if err != nil {
+			return nil, &authError{fmt.Sprintf("failed to get credentials: %v (%s)", err, authErrorHint)}
+		}
+		session.tokenSource = creds.TokenSource
+	}
+	return session, nil
+}
 
-		if config.Verbose {
-			if isImage {
-				sizeMB := float64(len(content)) / (1024 * 1024)
-				fmt.Fprintf(os.Stderr, "Attachment: %s (%s, %.2f MB) - within size limits\n", path, mimeType, sizeMB)
-			} else {
-				fmt.Fprintf(os.Stderr, "Attachment: %s (%s, %d bytes)\n", path, mimeType, len(content))
-			}
+// fetchToken returns an access token from the session's token source, giving up after
+// config.AuthTimeout. Token sources take no context and some, such as the metadata server, use
+// their own HTTP client that --timeout does not bound, so the wait is limited here instead. A
+// timeout is a retryable API error, as an unresponsive token endpoint is usually transient.
+func fetchToken(config *Config, session *apiSession) (*oauth2.Token, error) {
+	type tokenResult struct {
+		token *oauth2.Token
+		err   error
+	}
+	done := make(chan tokenResult, 1)
+	go func() {
+		token, err := session.tokenSource.Token()
+		done <- tokenResult{token, err}
+	}()
+
+	var deadline <-chan time.Time
+	if config.AuthTimeout > 0 {
+		timer := time.NewTimer(time.Duration(config.AuthTimeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case result := <-done:
+		if result.err != nil {
+			return nil, &authError{fmt.Sprintf("failed to get access token: %v (%s)", result.err, authErrorHint)}
+		}
+		return result.token, nil
+	case <-deadline:
+		return nil, &apiError{
+			message:   fmt.Sprintf("timed out after %ds waiting for an access token from %s (see --auth-timeout)", config.AuthTimeout, credentialsDescription(config)),
+			retryable: true,
 		}
 	}
+}
 
-	// Validate total attachment size doesn't approach the 20 MB request limit
-	const maxAttachmentBytes = 20 * 1024 * 1024
-	if totalEncodedBytes > maxAttachmentBytes {
-		totalMB := float64(totalEncodedBytes) / (1024 * 1024)
-		return nil, &inputError{fmt.Sprintf("total attachment size exceeds limit: %.2f MB encoded (limit 20 MB)", totalMB)}
+// credentialsDescription names the credentials source for --dump-effective-config without
+// revealing any credential content
+func credentialsDescription(config *Config) string {
+	switch config.CredentialsSource {
+	case credentialsSourceMetadata:
+		return "metadata server"
+	case credentialsSourceFile:
+		return "file " + config.CredentialsFile
+	default:
+		return "application default credentials"
 	}
+}
 
-	if len(attachments) > 0 && config.Verbose {
-		totalMB := float64(totalEncodedBytes) / (1024 * 1024)
-		fmt.Fprintf(os.Stderr, "Total attachments: %d files, %.2f MB (encoded) - within limits\n", len(attachments), totalMB)
+// newHTTPClient returns the client used for API calls and remote schema fetches. With
+// --prefer-ipv4, TCP connections are dialed over IPv4 first and fall back to IPv6 only when IPv4
+// fails; otherwise the default dual-stack behavior applies. --connect-timeout bounds each dial and
+// TLS handshake separately from the overall request timeout.
+func newHTTPClient(config *Config) *http.Client {
+	client := &http.Client{
+		Timeout: time.Duration(config.Timeout) * time.Second,
+	}
+	if !config.PreferIPv4 && config.ConnectTimeout == 0 {
+		return client
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ConnectTimeout > 0 {
+		dialer.Timeout = time.Duration(config.ConnectTimeout) * time.Second
+		transport.TLSHandshakeTimeout = dialer.Timeout
+	}
+	transport.DialContext = dialer.DialContext
+	client.Transport = transport
+	if !config.PreferIPv4 {
+		return client
 	}
 
-	return parts, nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		conn, err := dialer.DialContext(ctx, "tcp4", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if conn, fallbackErr := dialer.DialContext(ctx, "tcp6", addr); fallbackErr == nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+	return client
 }
 
-func buildGeminiRequest(config *Config, attachmentParts []interface{}) ([]byte, error) {
-	// Build parts array with prompt text and attachments
-	contentParts := []interface{}{
-		map[string]interface{}{
-			"text": config.Prompt,
-		},
+// parseRetryAfter parses a Retry-After header given either as delay seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
 	}
-	contentParts = append(contentParts, attachmentParts...)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date).Round(time.Second)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
 
-	request := map[string]interface{}{
-		"systemInstruction": map[string]interface{}{
-			"parts": []interface{}{
-				map[string]interface{}{
-					"text": config.SystemInstruction,
-				},
-			},
-		},
-		"contents": []interface{}{
-			map[string]interface{}{
-				"role":  "user",
-				"parts": contentParts,
-			},
-		},
-		"generationConfig": map[string]interface{}{
-			"responseMimeType":   "application/json",
-			"responseJsonSchema": config.Schema,
-		},
+// formatJSON formats a JSON object as minified, pretty-printed, or canonical
+func formatJSON(config *Config, jsonObj interface{}) (string, error) {
+	var formattedBytes []byte
+	var err error
+
+	if config.Normalize {
+		formattedBytes, err = canonicalJSON(jsonObj)
+	} else if config.Sorted {
+		formattedBytes, err = sortedJSON(jsonObj, config.PrettyPrint)
+	} else if config.PrettyPrint {
+		formattedBytes, err = json.MarshalIndent(jsonObj, "", "  ")
+	} else {
+		formattedBytes, err = json.Marshal(jsonObj)
 	}
 
-	requestBytes, err := json.Marshal(request)
 	if err != nil {
-		return nil, &inputError{fmt.Sprintf("failed to marshal request: %v", err)}
+		return "", err
 	}
 
-	return requestBytes, nil
+	return string(formattedBytes), nil
 }
 
-func buildGeminiURL(config *Config) string {
-	// For global region, use aiplatform.googleapis.com (no region prefix)
-	// For regional endpoints, use {region}-aiplatform.googleapis.com
-	var url string
-	if config.Location == "global" {
-		url = fmt.Sprintf("https://aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
-			config.Project, config.Location, config.Model)
-	} else {
-		url = fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
-			config.Location, config.Project, config.Location, config.Model)
+// formatResponseJSON formats a value decoded from rawResponse. Decoding into maps loses the order of
+// object members, so with --no-sort-keys the response is decoded again preserving it, and the keys
+// are written in that order instead of sorted.
+func formatResponseJSON(config *Config, jsonObj interface{}, rawResponse string) (string, error) {
+	if config.NoSortKeys {
+		declared, err := decodeOrdered([]byte(rawResponse))
+		if err != nil {
+			return "", err
+		}
+		jsonObj = inDeclaredOrder(jsonObj, declared)
 	}
-	return url
+	return formatJSON(config, jsonObj)
 }
 
-func callGeminiAPI(config *Config, requestBody []byte) (string, error) {
-	ctx := context.Background()
+// summarizeValidationError describes the most relevant failure of a schema validation error on one
+// line: the instance location (within the value at pointer), the failing keyword, and its message
+func summarizeValidationError(err error, pointer string) (string, bool) {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return "", false
+	}
+	issues := rankValidationIssues(validationErr, pointer)
+	summary := issues[0].String()
+	if others := len(issues) - 1; others > 0 {
+		summary += fmt.Sprintf(" (and %d more)", others)
+	}
+	return summary, true
+}
 
-	// Get credentials and token
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		return "", &apiError{fmt.Sprintf("failed to get credentials: %v", err)}
+// validateAndFormatJSON parses, validates, and formats JSON from LLM response, counting each
+// validation failure for --metrics-file
+func validateAndFormatJSON(config *Config, rawResponse string) (string, error) {
+	formattedJSON, err := checkAndFormatJSON(config, rawResponse)
+	if _, failed := err.(*validationError); failed {
+		config.Metrics.addValidationFailure()
 	}
+	return formattedJSON, err
+}
 
-	token, err := creds.TokenSource.Token()
+func checkAndFormatJSON(config *Config, rawResponse string) (string, error) {
+	// Try to parse JSON; strict numbers and sorted output keep each number exactly as written
+	var jsonObj interface{}
+	decoder := json.NewDecoder(strings.NewReader(rawResponse))
+	if config.StrictNumbers || config.Sorted {
+		decoder.UseNumber()
+	}
+	err := decoder.Decode(&jsonObj)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("invalid character after top-level value")
+	}
 	if err != nil {
-		return "", &apiError{fmt.Sprintf("failed to get access token: %v", err)}
+		// If parsing fails, return raw text with validation error
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Validation: response is not valid JSON - FAILED\n")
+		}
+		return rawResponse, &validationError{fmt.Sprintf("response is not valid JSON: %v", err)}
 	}
 
-	// Build URL
-	url := buildGeminiURL(config)
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Validation: response is valid JSON - PASSED\n")
+	}
 
-	if config.Verbose {
-		fmt.Fprintf(os.Stderr, "Request: POST %s\n", url)
+	// Defensive check for missing compiled schemas (should not happen in normal flow)
+	if len(config.CompiledSchemas) == 0 {
+		return rawResponse, &validationError{"schema not compiled"}
 	}
 
-	// Create request
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestBody))
-	if err != nil {
-		return "", &apiError{fmt.Sprintf("failed to create request: %v", err)}
+	// Validate the JSON (or only the subtree selected by --validate-pointer) against the pre-compiled schema
+	validationTarget := jsonObj
+	if config.ValidatePointer != "" {
+		target, err := resolveJSONPointer(jsonObj, config.ValidateTokens)
+		if err != nil {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Validation: value at %s - FAILED\n", config.ValidatePointer)
+			}
+			return rawResponse, &validationError{fmt.Sprintf("response has no value at --validate-pointer %s: %v", config.ValidatePointer, err)}
+		}
+		validationTarget = target
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Validation: validating only the value at %s\n", config.ValidatePointer)
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	// A self-describing response can name its own schema, used with or instead of the provided ones
+	schemas := config.CompiledSchemas
+	if config.EmbeddedSchema != "" {
+		embedded, err := loadEmbeddedSchema(config, validationTarget)
+		if err != nil {
+			if config.Verbosity >= verbosityRequest {
+				config.Log.Printf("Validation: response $schema - FAILED\n")
+			}
+			return rawResponse, err
+		}
+		if config.EmbeddedSchema == embeddedSchemaInstead {
+			schemas = nil
+		}
+		schemas = append(slices.Clip(schemas), embedded)
+	}
 
-	// Send request
-	client := &http.Client{
-		Timeout: time.Duration(config.Timeout) * time.Second,
+	// Every schema is checked so that all failures are reported, each attributed to its schema
+	var failures []string
+	for _, schema := range schemas {
+		err := schema.Schema.Validate(validationTarget)
+		if schema.CrossCheck != nil {
+			logDraftDivergence(config, schema, validationTarget, err)
+		}
+		if err != nil {
+			// A list of several issues can be long, so the key problem of the first failure is printed
+			// first; a single issue is already one line and would only be repeated
+			description := describeValidationFailure(err, config.ValidatePointer, config.MaxErrors)
+			if summary, ok := summarizeValidationError(err, config.ValidatePointer); ok && len(failures) == 0 && strings.Contains(description, "\n") {
+				config.Log.Printf("Validation summary: %s\n", summary)
+			}
+			if len(schemas) == 1 {
+				failures = append(failures, description)
+			} else {
+				failures = append(failures, fmt.Sprintf("%s: %s", schema.Src, description))
+			}
+		}
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", &apiError{fmt.Sprintf("failed to call API: %v", err)}
+	if len(failures) > 0 {
+		// If validation fails, return formatted JSON with validation error
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Validation: schema validation - FAILED\n")
+		}
+		message := "schema validation failed: " + failures[0]
+		if len(schemas) > 1 {
+			message = fmt.Sprintf("schema validation failed against %d of %d schemas:\n%s", len(failures), len(schemas), strings.Join(failures, "\n"))
+		}
+		formattedJSON, formatErr := formatResponseJSON(config, jsonObj, rawResponse)
+		if formatErr != nil {
+			return rawResponse, &validationError{fmt.Sprintf("%s (and formatting failed: %v)", message, formatErr)}
+		}
+		return formattedJSON, &validationError{message}
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", &apiError{fmt.Sprintf("failed to read response: %v", err)}
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Validation: schema validation - PASSED\n")
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", &apiError{fmt.Sprintf("API returned status %d: %s", resp.StatusCode, string(respBody))}
+	if config.StrictNumbers {
+		if err := checkIntegerLiterals(config, jsonObj); err != nil {
+			formattedJSON, formatErr := formatResponseJSON(config, jsonObj, rawResponse)
+			if formatErr != nil {
+				formattedJSON = rawResponse
+			}
+			return formattedJSON, err
+		}
 	}
 
-	// Parse response
-	var geminiResp struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-			FinishReason  string `json:"finishReason"`
-			FinishMessage string `json:"finishMessage"`
-		} `json:"candidates"`
-		UsageMetadata struct {
-			PromptTokenCount     int `json:"promptTokenCount"`
-			CandidatesTokenCount int `json:"candidatesTokenCount"`
-			TotalTokenCount      int `json:"totalTokenCount"`
-		} `json:"usageMetadata"`
+	// A permissive schema may accept an empty result that in practice means the model extracted nothing
+	if config.FailOnEmpty && isEmptyContainer(jsonObj) {
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Validation: non-empty result - FAILED\n")
+		}
+		formattedJSON, formatErr := formatResponseJSON(config, jsonObj, rawResponse)
+		if formatErr != nil {
+			formattedJSON = rawResponse
+		}
+		return formattedJSON, &validationError{"response is an empty top-level object or array (--fail-on-empty-object)"}
 	}
 
-	if err := json.Unmarshal(respBody, &geminiResp); err != nil {
-		return "", &validationError{fmt.Sprintf("failed to parse response: %v", err)}
+	if config.MinConfidence != nil {
+		if err := checkConfidence(config, jsonObj); err != nil {
+			formattedJSON, formatErr := formatResponseJSON(config, jsonObj, rawResponse)
+			if formatErr != nil {
+				return rawResponse, err
+			}
+			return formattedJSON, err
+		}
 	}
 
-	if len(geminiResp.Candidates) == 0 {
-		return "", &validationError{"no candidates in response"}
+	// Defaults are filled only once the response itself has passed every check
+	if config.ApplyDefaults {
+		applied := applySchemaDefaults(config.Schema, config.Schema, validationTarget)
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Defaults: %d schema default values applied\n", applied)
+		}
+		if applied > 0 {
+			// A default can still conflict with the rest of the schema, so the filled result is checked
+			// again against the same schemas as the response, including an embedded one
+			for _, schema := range schemas {
+				if err := schema.Schema.Validate(validationTarget); err != nil {
+					formattedJSON, formatErr := formatResponseJSON(config, jsonObj, rawResponse)
+					if formatErr != nil {
+						formattedJSON = rawResponse
+					}
+					description := describeValidationFailure(err, config.ValidatePointer, config.MaxErrors)
+					if len(schemas) > 1 {
+						description = fmt.Sprintf("%s: %s", schema.Src, description)
+					}
+					return formattedJSON, &validationError{"result with schema defaults applied failed validation: " + description}
+				}
+			}
+		}
 	}
 
-	candidate := geminiResp.Candidates[0]
+	// If validation succeeds, return formatted JSON with no error
+	formattedJSON, err := formatResponseJSON(config, jsonObj, rawResponse)
+	if err != nil {
+		return rawResponse, &validationError{fmt.Sprintf("formatting failed: %v", err)}
+	}
 
-	// Check finish reason
-	if candidate.FinishReason != "STOP" {
-		// Include finishMessage in error for better diagnostics
-		errorMsg := fmt.Sprintf("unexpected finish reason: %s", candidate.FinishReason)
-		if candidate.FinishMessage != "" {
-			errorMsg = fmt.Sprintf("%s (finishMessage: %s)", errorMsg, candidate.FinishMessage)
-			// Log finishMessage to STDERR even when not in verbose mode
-			fmt.Fprintf(os.Stderr, "Generation stopped: finishReason=%s, finishMessage=%s\n", candidate.FinishReason, candidate.FinishMessage)
-		} else {
-			fmt.Fprintf(os.Stderr, "Generation stopped: finishReason=%s\n", candidate.FinishReason)
+	return formattedJSON, nil
+}
+
+// checkIntegerLiterals requires every value typed integer by the schema (within the
+// --validate-pointer subtree when set) to be written as an integer. With --coerce-integers the
+// integral values are rewritten in jsonObj instead, and each coercion is logged in verbose mode.
+func checkIntegerLiterals(config *Config, jsonObj interface{}) error {
+	check := &integerLiteralCheck{root: config.Schema, coerce: config.CoerceIntegers}
+	tokens := config.ValidateTokens
+	if len(tokens) == 0 {
+		check.check(config.Schema, jsonObj, "")
+	} else {
+		// The target is replaced within its parent so that a coerced scalar reaches the output
+		parent, _ := resolveJSONPointer(jsonObj, tokens[:len(tokens)-1])
+		target, _ := resolveJSONPointer(jsonObj, tokens)
+		coerced := check.check(config.Schema, target, config.ValidatePointer)
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[tokens[len(tokens)-1]] = coerced
+		case []interface{}:
+			index, _ := strconv.Atoi(tokens[len(tokens)-1])
+			p[index] = coerced
 		}
-		return "", &validationError{errorMsg}
 	}
 
-	if len(candidate.Content.Parts) == 0 {
-		return "", &validationError{"no content parts in response"}
+	if len(check.violations) > 0 {
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Validation: integer literals - FAILED\n")
+		}
+		return &validationError{"strict number check failed: " + strings.Join(check.violations, "; ")}
+	}
+	if config.Verbosity >= verbosityRequest {
+		for _, coercion := range check.coercions {
+			config.Log.Printf("Coerced integer at %s\n", coercion)
+		}
+		config.Log.Printf("Validation: integer literals - PASSED\n")
 	}
+	return nil
+}
 
-	// Concatenate all parts[].text in order
-	var jsonTextBuilder strings.Builder
-	for _, part := range candidate.Content.Parts {
-		jsonTextBuilder.WriteString(part.Text)
+// isEmptyContainer reports whether a decoded JSON value is an empty object or an empty array
+func isEmptyContainer(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
 	}
-	jsonText := jsonTextBuilder.String()
+	return false
+}
 
-	if jsonText == "" {
-		return "", &validationError{"empty response text"}
+// checkConfidence verifies that the value at the confidence pointer is a number that meets the
+// --min-confidence threshold
+func checkConfidence(config *Config, jsonObj interface{}) error {
+	value, err := resolveJSONPointer(jsonObj, config.ConfidenceTokens)
+	if err != nil {
+		return &validationError{fmt.Sprintf("response has no confidence value at %s: %v", config.ConfidencePointer, err)}
+	}
+	var confidence float64
+	switch v := value.(type) {
+	case float64:
+		confidence = v
+	case json.Number:
+		confidence, err = v.Float64()
+	default:
+		err = fmt.Errorf("not a number")
+	}
+	if err != nil {
+		return &validationError{fmt.Sprintf("confidence value at %s is not a number", config.ConfidencePointer)}
 	}
 
-	// Log token usage if verbose
-	if config.Verbose {
-		fmt.Fprintf(os.Stderr, "API response: finish_reason=%s\n", candidate.FinishReason)
-		if geminiResp.UsageMetadata.TotalTokenCount > 0 {
-			fmt.Fprintf(os.Stderr, "Token usage:\n")
-			fmt.Fprintf(os.Stderr, "  promptTokenCount:     %d\n", geminiResp.UsageMetadata.PromptTokenCount)
-			fmt.Fprintf(os.Stderr, "  candidatesTokenCount: %d\n", geminiResp.UsageMetadata.CandidatesTokenCount)
-			fmt.Fprintf(os.Stderr, "  totalTokenCount:      %d\n", geminiResp.UsageMetadata.TotalTokenCount)
+	if confidence < *config.MinConfidence {
+		if config.Verbosity >= verbosityRequest {
+			config.Log.Printf("Confidence: %v at %s is below minimum %v - FAILED\n", confidence, config.ConfidencePointer, *config.MinConfidence)
 		}
+		return &confidenceError{fmt.Sprintf("confidence %v at %s is below --min-confidence %v", confidence, config.ConfidencePointer, *config.MinConfidence)}
 	}
 
-	return jsonText, nil
+	if config.Verbosity >= verbosityRequest {
+		config.Log.Printf("Confidence: %v at %s meets minimum %v - PASSED\n", confidence, config.ConfidencePointer, *config.MinConfidence)
+	}
+	return nil
 }
 
-// formatJSON formats a JSON object as minified or pretty-printed
-func formatJSON(jsonObj interface{}, prettyPrint bool) (string, error) {
-	var formattedBytes []byte
-	var err error
+// effectiveConfig describes the fully resolved configuration, after flags, environment variables,
+// and defaults have been applied. Instruction, schema, and prompt content is summarized by source
+// and size rather than included, and no credentials are ever part of it.
+func effectiveConfig(config *Config) map[string]interface{} {
+	schemaSrcs := make([]string, 0, len(config.CompiledSchemas))
+	for _, schema := range config.CompiledSchemas {
+		schemaSrcs = append(schemaSrcs, schema.Src)
+	}
 
-	if prettyPrint {
-		formattedBytes, err = json.MarshalIndent(jsonObj, "", "  ")
-	} else {
-		formattedBytes, err = json.Marshal(jsonObj)
+	prompt := map[string]interface{}{
+		"source": config.PromptSrc,
+		"bytes":  len(config.Prompt),
+	}
+	if len(config.Prompts) > 0 {
+		prompt["count"] = len(config.Prompts)
+		prompt["resultsFormat"] = config.ResultsFormat
+		delete(prompt, "bytes")
+	} else if config.REPL {
+		prompt["repl"] = true
+		delete(prompt, "bytes")
 	}
 
-	if err != nil {
-		return "", err
+	generation := map[string]interface{}{}
+	if config.Temperature != nil {
+		generation["temperature"] = *config.Temperature
+	}
+	if config.TopK != nil {
+		generation["topK"] = *config.TopK
+	}
+	if config.Seed != nil {
+		generation["seed"] = *config.Seed
+	}
+	if config.CandidateCount > 0 {
+		generation["candidateCount"] = config.CandidateCount
+	}
+	if config.Logprobs > 0 {
+		generation["logprobs"] = config.Logprobs
 	}
 
-	return string(formattedBytes), nil
+	effective := map[string]interface{}{
+		"requestId":        config.RequestID,
+		"project":          config.Project,
+		"quotaProject":     config.QuotaProject,
+		"locations":        config.Locations,
+		"model":            config.Model,
+		"fallbackModel":    config.FallbackModel,
+		"url":              buildGeminiURL(config),
+		"credentials":      credentialsDescription(config),
+		"scopes":           config.Scopes,
+		"timeout":          config.Timeout,
+		"connectTimeout":   config.ConnectTimeout,
+		"authTimeout":      config.AuthTimeout,
+		"maxResponseBytes": config.MaxResponseBytes,
+		"maxRetries":       config.MaxRetries,
+		"retryJitter":      config.RetryBackoff.jitter,
+		"maxAttachments":   config.MaxAttachments,
+		"systemInstruction": map[string]interface{}{
+			"source": config.SystemInstructionSrc,
+			"bytes":  len(config.SystemInstruction),
+			"sha256": config.SystemInstructionSHA256,
+		},
+		"schemas":          schemaSrcs,
+		"genSchema":        config.GenSchemaSrc,
+		"propertyOrdering": config.PropertyOrdering,
+		"validatePointer":  config.ValidatePointer,
+		"prompt":           prompt,
+		"attachments":      append([]string{}, attachments...),
+		"generationConfig": generation,
+		"grounding":        config.Grounding,
+		"output": map[string]interface{}{
+			"file":            config.OutFile,
+			"prettyPrint":     config.PrettyPrint,
+			"normalize":       config.Normalize,
+			"sorted":          config.Sorted,
+			"noSortKeys":      config.NoSortKeys,
+			"prettyStdout":    config.PrettyStdout,
+			"embedMetadata":   config.EmbedMetadata,
+			"bom":             config.BOM,
+			"crlf":            config.CRLF,
+			"trailingNewline": config.TrailingNewline,
+		},
+		"validationExitCode": validationExitCode,
+		"degradeSchema":      config.DegradeAfter,
+		"retryOnValidation":  config.RetryOnValidation,
+		"verbosity":          config.Verbosity,
+	}
+	if config.MinConfidence != nil {
+		effective["minConfidence"] = *config.MinConfidence
+		effective["confidencePointer"] = config.ConfidencePointer
+	}
+	if config.PDFChunkPages > 0 {
+		effective["pdfChunkPages"] = config.PDFChunkPages
+		effective["mergeStrategy"] = config.MergeStrategy
+	}
+	return effective
 }
 
-// validateAndFormatJSON parses, validates, and formats JSON from LLM response
-func validateAndFormatJSON(config *Config, rawResponse string) (string, error) {
-	// Try to parse JSON
-	var jsonObj interface{}
-	if err := json.Unmarshal([]byte(rawResponse), &jsonObj); err != nil {
-		// If parsing fails, return raw text with validation error
-		if config.Verbose {
-			fmt.Fprintf(os.Stderr, "Validation: response is not valid JSON - FAILED\n")
-		}
-		return rawResponse, &validationError{fmt.Sprintf("response is not valid JSON: %v", err)}
+// embedResultMetadata wraps the validated result in an envelope recording what produced it:
+// {"result": ..., "meta": {"model", "promptSrc", "schemaSrc", "timestamp", "version"}}
+func embedResultMetadata(config *Config, formattedJSON string) (string, error) {
+	var result interface{}
+	decoder := json.NewDecoder(strings.NewReader(formattedJSON))
+	if config.Sorted {
+		decoder.UseNumber()
 	}
-
-	if config.Verbose {
-		fmt.Fprintf(os.Stderr, "Validation: response is valid JSON - PASSED\n")
+	if err := decoder.Decode(&result); err != nil {
+		return "", &validationError{fmt.Sprintf("failed to embed metadata: %v", err)}
 	}
-
-	// Defensive check for nil compiled schema (should not happen in normal flow)
-	if config.CompiledSchema == nil {
-		return rawResponse, &validationError{"schema not compiled"}
+	if config.NoSortKeys {
+		declared, _ := decodeOrdered([]byte(formattedJSON))
+		result = inDeclaredOrder(result, declared)
 	}
 
-	// Validate the JSON against the pre-compiled schema
-	if err := config.CompiledSchema.Validate(jsonObj); err != nil {
-		// If validation fails, return formatted JSON with validation error
-		if config.Verbose {
-			fmt.Fprintf(os.Stderr, "Validation: schema validation - FAILED\n")
-		}
-		formattedJSON, formatErr := formatJSON(jsonObj, config.PrettyPrint)
-		if formatErr != nil {
-			return rawResponse, &validationError{fmt.Sprintf("schema validation failed: %v (and formatting failed: %v)", err, formatErr)}
-		}
-		return formattedJSON, &validationError{fmt.Sprintf("schema validation failed: %v", err)}
+	meta := map[string]interface{}{
+		"model":     config.Model,
+		"promptSrc": config.PromptSrc,
+		"schemaSrc": config.SchemaSrc,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"version":   Version,
+	}
+	if config.DegradeAfter > 0 {
+		meta["degraded"] = config.Degraded
+	}
+	if version := config.Usage.lastVersion(); version != "" {
+		meta["modelVersion"] = version
 	}
 
-	if config.Verbose {
-		fmt.Fprintf(os.Stderr, "Validation: schema validation - PASSED\n")
+	envelope := map[string]interface{}{
+		"result": result,
+		"meta":   meta,
 	}
 
-	// If validation succeeds, return formatted JSON with no error
-	formattedJSON, err := formatJSON(jsonObj, config.PrettyPrint)
+	wrapped, err := formatJSON(config, envelope)
 	if err != nil {
-		return rawResponse, &validationError{fmt.Sprintf("formatting failed: %v", err)}
+		return "", &validationError{fmt.Sprintf("failed to embed metadata: %v", err)}
 	}
-
-	return formattedJSON, nil
+	return wrapped, nil
 }
 
 func writeOutput(config *Config, jsonText string) error {
+	// A FIFO or other non-regular --out file is appended to rather than replaced
+	outStream := false
 	if config.OutFile != "" {
-		if err := os.WriteFile(config.OutFile, []byte(jsonText), 0644); err != nil {
+		if info, err := os.Stat(config.OutFile); err == nil && !info.Mode().IsRegular() && !info.IsDir() {
+			outStream = true
+		}
+	}
+	if config.TrailingNewline {
+		jsonText += "\n"
+	}
+
+	// Apply output encoding options to the final text
+	if config.CRLF {
+		jsonText = strings.ReplaceAll(jsonText, "\n", "\r\n")
+	}
+	output := []byte(jsonText)
+	if config.BOM {
+		output = append([]byte("\xEF\xBB\xBF"), output...)
+	}
+
+	if outStream {
+		file, err := os.OpenFile(config.OutFile, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return &inputError{fmt.Sprintf("failed to open output file: %v", err)}
+		}
+		defer file.Close()
+		if _, err := file.Write(output); err != nil {
+			return &inputError{fmt.Sprintf("failed to write output file: %v", err)}
+		}
+	} else if config.OutFile != "" {
+		if err := os.WriteFile(config.OutFile, output, 0644); err != nil {
 			return &inputError{fmt.Sprintf("failed to write output file: %v", err)}
 		}
 	} else {
-		fmt.Println(jsonText)
+		os.Stdout.Write(output)
 	}
 	return nil
 }
 
+// withRequestID appends the request ID to the message of an error returned by an API call so the
+// failure can be correlated with gateway and server logs
+func withRequestID(err error, requestID string) error {
+	if err == nil || requestID == "" {
+		return err
+	}
+	suffix := fmt.Sprintf(" [request id: %s]", requestID)
+	switch e := err.(type) {
+	case *inputError:
+		e.message += suffix
+	case *validationError:
+		e.message += suffix
+	case *apiError:
+		e.message += suffix
+	case *quotaError:
+		e.message += suffix
+	case *authError:
+		e.message += suffix
+	}
+	return err
+}
+
+// newRequestID returns a random (version 4) UUID
+func newRequestID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
 // Error types for different exit codes
 type cliError struct {
 	message string
@@ -798,13 +4327,100 @@ func (e *validationError) Error() string {
 }
 
 type apiError struct {
-	message string
+	message   string
+	retryable bool // Transient failure (network error, HTTP 5xx or 408) that may succeed when retried
 }
 
 func (e *apiError) Error() string {
 	return e.message
 }
 
+// quotaError indicates the API rejected the request due to quota exhaustion (HTTP 429 / RESOURCE_EXHAUSTED)
+type quotaError struct {
+	message    string
+	retryAfter time.Duration // Zero when the response did not include a Retry-After header
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// authError indicates credentials could not be obtained or the API rejected them (HTTP 401/403)
+type authError struct {
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// confidenceError indicates a valid response whose confidence value is below --min-confidence
+type confidenceError struct {
+	message string
+}
+
+func (e *confidenceError) Error() string {
+	return e.message
+}
+
+// driftError indicates a valid result that differs from the --baseline-file with --fail-on-diff
+type driftError struct {
+	message string
+}
+
+func (e *driftError) Error() string {
+	return e.message
+}
+
+// warningError indicates that advisory warnings fired with --fail-on-warnings
+type warningError struct {
+	message string
+}
+
+func (e *warningError) Error() string {
+	return e.message
+}
+
+// writeStatusLine writes the p2j-result line of --status-line, which names the outcome and exit
+// status of the run independently of the human-readable error text
+func writeStatusLine(err error) {
+	result := struct {
+		Status   string `json:"status"`
+		ExitCode int    `json:"exitCode"`
+	}{Status: exitStatusName(err)}
+	if err != nil {
+		result.ExitCode = getExitCode(err)
+	}
+	line, _ := json.Marshal(result)
+	fmt.Fprintf(os.Stderr, "p2j-result: %s\n", line)
+}
+
+// exitStatusName names the category of the error that determines the exit status
+func exitStatusName(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case *cliError:
+		return "cli"
+	case *inputError:
+		return "input"
+	case *apiError:
+		return "api"
+	case *quotaError:
+		return "quota"
+	case *authError:
+		return "auth"
+	case *confidenceError:
+		return "confidence"
+	case *driftError:
+		return "drift"
+	case *warningError:
+		return "warning"
+	default:
+		return "validation"
+	}
+}
+
 func getExitCode(err error) int {
 	switch err.(type) {
 	case *cliError:
@@ -812,9 +4428,19 @@ func getExitCode(err error) int {
 	case *inputError:
 		return exitInputError
 	case *validationError:
-		return exitValidationError
+		return validationExitCode
 	case *apiError:
 		return exitAPIError
+	case *quotaError:
+		return exitQuotaError
+	case *authError:
+		return exitAuthError
+	case *confidenceError:
+		return exitConfidenceError
+	case *driftError:
+		return exitDriftError
+	case *warningError:
+		return exitWarningError
 	default:
 		return exitValidationError
 	}
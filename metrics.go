@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runMetrics counts the API requests and validation failures of a run for --metrics-file
+type runMetrics struct {
+	mu                 sync.Mutex
+	requests           int
+	requestDuration    time.Duration
+	validationFailures int
+}
+
+// addRequest records one generateContent attempt, whatever its outcome, and the time it took
+func (m *runMetrics) addRequest(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	m.requestDuration += duration
+}
+
+func (m *runMetrics) addValidationFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.validationFailures++
+}
+
+// writeMetricsFile replaces the --metrics-file with the metrics of this run in the Prometheus text
+// exposition format. Every value describes only this run, so each is a gauge rather than a counter
+// that would reset with every rewrite. The file is written under a temporary name and renamed into
+// place, so that a textfile collector never reads it half-written.
+func writeMetricsFile(config *Config) error {
+	config.Metrics.mu.Lock()
+	requests, duration, failures := config.Metrics.requests, config.Metrics.requestDuration, config.Metrics.validationFailures
+	config.Metrics.mu.Unlock()
+	config.Usage.mu.Lock()
+	promptTokens, candidatesTokens, totalTokens := config.Usage.PromptTokenCount, config.Usage.CandidatesTokenCount, config.Usage.TotalTokenCount
+	config.Usage.mu.Unlock()
+
+	var b strings.Builder
+	writeMetric := func(name, kind, help string, samples ...string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, sample := range samples {
+			fmt.Fprintf(&b, "%s\n", sample)
+		}
+	}
+	writeMetric("prompt2json_request_count", "gauge", "generateContent requests attempted during the last run, including retries",
+		fmt.Sprintf("prompt2json_request_count %d", requests))
+	writeMetric("prompt2json_request_duration_seconds", "gauge", "Time spent on generateContent requests during the last run, including obtaining the access token",
+		"prompt2json_request_duration_seconds "+strconv.FormatFloat(duration.Seconds(), 'f', -1, 64))
+	writeMetric("prompt2json_tokens", "gauge", "Tokens reported in the usageMetadata of the last run's responses",
+		fmt.Sprintf(`prompt2json_tokens{type="prompt"} %d`, promptTokens),
+		fmt.Sprintf(`prompt2json_tokens{type="candidates"} %d`, candidatesTokens),
+		fmt.Sprintf(`prompt2json_tokens{type="total"} %d`, totalTokens))
+	writeMetric("prompt2json_validation_failures", "gauge", "Responses that failed validation during the last run",
+		fmt.Sprintf("prompt2json_validation_failures %d", failures))
+
+	temp, err := os.CreateTemp(filepath.Dir(config.MetricsFile), "."+filepath.Base(config.MetricsFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics file: %v", err)
+	}
+	_, writeErr := temp.WriteString(b.String())
+	closeErr := temp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		// CreateTemp creates the file readable only by its owner
+		writeErr = os.Chmod(temp.Name(), 0644)
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(temp.Name(), config.MetricsFile)
+	}
+	if writeErr != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("failed to write metrics file: %v", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// Most $ref hops followed to reach the schema of a single value, which stops reference cycles
+const maxSchemaRefHops = 32
+
+// integerLiteralCheck walks a response decoded with UseNumber alongside its schema and finds the
+// integer-typed values that are not written as integer literals, such as 5.0 or 5e2
+type integerLiteralCheck struct {
+	root       map[string]interface{} // Schema that local $ref pointers are resolved against
+	coerce     bool                   // Rewrite integral values as integer literals instead of reporting them
+	violations []string
+	coercions  []string
+}
+
+// check returns the value with any coercions applied. Containers are updated in place.
+func (c *integerLiteralCheck) check(schema map[string]interface{}, value interface{}, path string) interface{} {
+	schema = followLocalRefs(c.root, schema)
+	for _, subschema := range schemaList(schema["allOf"]) {
+		if subschema != nil {
+			value = c.check(subschema, value, path)
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		if isIntegerTyped(schema) {
+			return c.checkNumber(v, path)
+		}
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		// Members are visited in sorted order so that violations are reported deterministically
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			member := v[key]
+			memberSchema, ok := properties[key].(map[string]interface{})
+			if !ok {
+				memberSchema = additional
+			}
+			if memberSchema != nil {
+				v[key] = c.check(memberSchema, member, path+"/"+escapeJSONPointerToken(key))
+			}
+		}
+	case []interface{}:
+		prefixItems := schemaList(schema["prefixItems"])
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range v {
+			itemSchema := items
+			if i < len(prefixItems) {
+				itemSchema = prefixItems[i]
+			}
+			if itemSchema != nil {
+				v[i] = c.check(itemSchema, item, fmt.Sprintf("%s/%d", path, i))
+			}
+		}
+	}
+	return value
+}
+
+func (c *integerLiteralCheck) checkNumber(number json.Number, path string) interface{} {
+	literal := number.String()
+	if !strings.ContainsAny(literal, ".eE") {
+		return number
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	// A value with a fractional part is left for schema validation to reject
+	rat, ok := new(big.Rat).SetString(literal)
+	if !ok || !rat.IsInt() {
+		return number
+	}
+	if !c.coerce {
+		c.violations = append(c.violations, fmt.Sprintf("%s must be written as an integer, got %s", path, literal))
+		return number
+	}
+	coerced := json.Number(rat.Num().String())
+	c.coercions = append(c.coercions, fmt.Sprintf("%s from %s to %s", path, literal, coerced))
+	return coerced
+}
+
+// followLocalRefs follows $ref pointers within the root schema ("#/$defs/name") and returns the
+// schema they lead to. Remote references are not followed.
+func followLocalRefs(root, schema map[string]interface{}) map[string]interface{} {
+	for hops := 0; hops < maxSchemaRefHops; hops++ {
+		ref, ok := schema["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#") {
+			break
+		}
+		tokens, err := parseJSONPointer(ref[1:])
+		if err != nil {
+			break
+		}
+		target, err := resolveJSONPointer(root, tokens)
+		if err != nil {
+			break
+		}
+		resolved, ok := target.(map[string]interface{})
+		if !ok {
+			break
+		}
+		schema = resolved
+	}
+	return schema
+}
+
+// isIntegerTyped reports whether the schema's type is integer, alone or alongside null
+func isIntegerTyped(schema map[string]interface{}) bool {
+	switch t := schema["type"].(type) {
+	case string:
+		return t == "integer"
+	case []interface{}:
+		integer := false
+		for _, name := range t {
+			switch name {
+			case "integer":
+				integer = true
+			case "null":
+			default:
+				return false
+			}
+		}
+		return integer
+	}
+	return false
+}
+
+// schemaList returns the subschemas of an array keyword such as allOf or prefixItems by position,
+// with nil for an entry that is not an object (such as a boolean schema)
+func schemaList(value interface{}) []map[string]interface{} {
+	items, _ := value.([]interface{})
+	schemas := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		schemas[i], _ = item.(map[string]interface{})
+	}
+	return schemas
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Keywords of the OpenAPI subset accepted by Gemini's responseSchema that are copied unchanged
+var openAPIPassthroughKeywords = []string{
+	"title", "description", "format", "default", "example", "propertyOrdering",
+	"minimum", "maximum", "minLength", "maxLength", "pattern",
+	"minItems", "maxItems", "minProperties", "maxProperties",
+}
+
+// JSON Schema types and the OpenAPI type names used by responseSchema
+var openAPITypeNames = map[string]string{
+	"string":  "STRING",
+	"number":  "NUMBER",
+	"integer": "INTEGER",
+	"boolean": "BOOLEAN",
+	"array":   "ARRAY",
+	"object":  "OBJECT",
+}
+
+// openAPIConverter translates a JSON Schema into the OpenAPI subset of responseSchema for
+// --json-schema-to-openapi. Keywords without an equivalent are dropped and reported as warnings.
+type openAPIConverter struct {
+	root     map[string]interface{} // Schema that local $ref pointers are resolved against
+	refs     []string               // $ref pointers being inlined, to detect recursion
+	warnings []string
+}
+
+// convertToOpenAPISchema returns the OpenAPI-subset equivalent of the schema and a warning for each
+// keyword that could not be translated. A recursive $ref cannot be inlined and is an error.
+func convertToOpenAPISchema(schema map[string]interface{}) (map[string]interface{}, []string, error) {
+	c := &openAPIConverter{root: schema}
+	converted, err := c.convert(schema, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return converted, c.warnings, nil
+}
+
+func (c *openAPIConverter) convert(schema map[string]interface{}, path string) (map[string]interface{}, error) {
+	// OpenAPI has no references, so local ones are inlined
+	if ref, ok := schema["$ref"].(string); ok {
+		if slices.Contains(c.refs, ref) {
+			return nil, &inputError{fmt.Sprintf("cannot convert recursive $ref %s at %s to OpenAPI", ref, pointerOrRoot(path))}
+		}
+		resolved := followLocalRefs(c.root, map[string]interface{}{"$ref": ref})
+		if _, unresolved := resolved["$ref"]; unresolved {
+			return nil, &inputError{fmt.Sprintf("cannot convert $ref %s at %s to OpenAPI (only local references can be inlined)", ref, pointerOrRoot(path))}
+		}
+		c.refs = append(c.refs, ref)
+		defer func() { c.refs = c.refs[:len(c.refs)-1] }()
+		return c.convert(resolved, path)
+	}
+
+	result := map[string]interface{}{}
+	for _, keyword := range openAPIPassthroughKeywords {
+		if value, ok := schema[keyword]; ok {
+			result[keyword] = value
+		}
+	}
+
+	if err := c.convertType(schema, path, result); err != nil {
+		return nil, err
+	}
+	c.convertEnum(schema, path, result)
+	if err := c.convertSubschemas(schema, path, result); err != nil {
+		return nil, err
+	}
+
+	// Everything else has no responseSchema equivalent
+	handled := map[string]bool{
+		"type": true, "enum": true, "const": true, "properties": true, "required": true, "items": true,
+		"anyOf": true, "oneOf": true, "nullable": true, "$schema": true, "$id": true, "$defs": true,
+		"definitions": true, "$comment": true,
+	}
+	for _, keyword := range slices.Sorted(maps.Keys(schema)) {
+		if !handled[keyword] && !slices.Contains(openAPIPassthroughKeywords, keyword) {
+			c.warn(path, fmt.Sprintf("dropped %s, which responseSchema does not support", keyword))
+		}
+	}
+	return result, nil
+}
+
+// convertType translates type, where null becomes nullable and several other types become anyOf
+func (c *openAPIConverter) convertType(schema map[string]interface{}, path string, result map[string]interface{}) error {
+	if nullable, ok := schema["nullable"].(bool); ok && nullable {
+		result["nullable"] = true
+	}
+
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+
+	var names []string
+	for _, t := range types {
+		if t == "null" {
+			result["nullable"] = true
+			continue
+		}
+		name, ok := openAPITypeNames[t]
+		if !ok {
+			return &inputError{fmt.Sprintf("cannot convert type %q at %s to OpenAPI", t, pointerOrRoot(path))}
+		}
+		names = append(names, name)
+	}
+	switch {
+	case len(names) == 1:
+		result["type"] = names[0]
+	case len(names) > 1:
+		// The other keywords apply to the alternatives that share their type, which anyOf cannot express
+		c.warn(path, "converted multiple types to anyOf of the bare types")
+		alternatives := make([]interface{}, len(names))
+		for i, name := range names {
+			alternatives[i] = map[string]interface{}{"type": name}
+		}
+		result["anyOf"] = alternatives
+	case len(types) > 0 && result["nullable"] == true:
+		return &inputError{fmt.Sprintf("cannot convert type null at %s to OpenAPI, which only supports nullable values of another type", pointerOrRoot(path))}
+	}
+	return nil
+}
+
+// convertEnum keeps string enums and turns a string const into a single-value enum
+func (c *openAPIConverter) convertEnum(schema map[string]interface{}, path string, result map[string]interface{}) {
+	values, hasEnum := schema["enum"].([]interface{})
+	if constValue, ok := schema["const"]; ok {
+		values, hasEnum = []interface{}{constValue}, true
+	}
+	if !hasEnum {
+		return
+	}
+
+	var strs []interface{}
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			strs = append(strs, v)
+		case nil:
+			result["nullable"] = true
+		default:
+			c.warn(path, fmt.Sprintf("dropped the non-string enum value %v, since responseSchema enums are strings", v))
+		}
+	}
+	if len(strs) > 0 {
+		result["enum"] = strs
+		if _, typed := result["type"]; !typed {
+			result["type"] = "STRING"
+		}
+	}
+}
+
+func (c *openAPIConverter) convertSubschemas(schema map[string]interface{}, path string, result map[string]interface{}) error {
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		converted := make(map[string]interface{}, len(properties))
+		for _, name := range slices.Sorted(maps.Keys(properties)) {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				c.warn(path+"/properties/"+escapeJSONPointerToken(name), "dropped a boolean schema")
+				continue
+			}
+			value, err := c.convert(property, path+"/properties/"+escapeJSONPointerToken(name))
+			if err != nil {
+				return err
+			}
+			converted[name] = value
+		}
+		result["properties"] = converted
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		result["required"] = required
+	}
+
+	switch items := schema["items"].(type) {
+	case map[string]interface{}:
+		converted, err := c.convert(items, path+"/items")
+		if err != nil {
+			return err
+		}
+		result["items"] = converted
+	case bool:
+		c.warn(path+"/items", "dropped a boolean schema")
+	}
+
+	// oneOf is treated as anyOf, which responseSchema supports; exclusivity is not enforced
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		alternatives, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		if keyword == "oneOf" {
+			c.warn(path, "converted oneOf to anyOf")
+		}
+		var converted []interface{}
+		for i, alternative := range alternatives {
+			subschema, ok := alternative.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// An alternative that only allows null makes the value nullable instead
+			if t, _ := subschema["type"].(string); t == "null" && len(subschema) == 1 {
+				result["nullable"] = true
+				continue
+			}
+			value, err := c.convert(subschema, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+			if err != nil {
+				return err
+			}
+			converted = append(converted, value)
+		}
+		switch {
+		case len(converted) == 1 && result["type"] == nil && result["anyOf"] == nil:
+			// A single remaining alternative is the schema itself, such as for anyOf [X, null]
+			for key, value := range converted[0].(map[string]interface{}) {
+				result[key] = value
+			}
+		case len(converted) > 0:
+			result["anyOf"] = append(toInterfaceSlice(result["anyOf"]), converted...)
+		}
+	}
+	return nil
+}
+
+func (c *openAPIConverter) warn(path, message string) {
+	c.warnings = append(c.warnings, fmt.Sprintf("%s: %s", pointerOrRoot(path), message))
+}
+
+func toInterfaceSlice(value interface{}) []interface{} {
+	items, _ := value.([]interface{})
+	return items
+}
+
+// pointerOrRoot returns a JSON Pointer for messages, using "/" for the root
+func pointerOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
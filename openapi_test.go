@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertToOpenAPISchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		want     string
+		warnings []string
+		err      string
+	}{
+		{
+			name:   "type array with null",
+			schema: `{"type": ["string", "null"], "maxLength": 10}`,
+			want:   `{"type": "STRING", "nullable": true, "maxLength": 10}`,
+		},
+		{
+			name:     "type array with several types",
+			schema:   `{"type": ["string", "integer"]}`,
+			want:     `{"anyOf": [{"type": "STRING"}, {"type": "INTEGER"}]}`,
+			warnings: []string{"/: converted multiple types to anyOf of the bare types"},
+		},
+		{
+			name:   "anyOf with null",
+			schema: `{"anyOf": [{"type": "integer", "minimum": 0}, {"type": "null"}]}`,
+			want:   `{"type": "INTEGER", "minimum": 0, "nullable": true}`,
+		},
+		{
+			name:   "string const",
+			schema: `{"const": "fixed"}`,
+			want:   `{"type": "STRING", "enum": ["fixed"]}`,
+		},
+		{
+			name:     "non-string const",
+			schema:   `{"type": "integer", "const": 3}`,
+			want:     `{"type": "INTEGER"}`,
+			warnings: []string{"/: dropped the non-string enum value 3, since responseSchema enums are strings"},
+		},
+		{
+			name: "local $ref inlined",
+			schema: `{
+				"type": "object",
+				"properties": {"home": {"$ref": "#/$defs/address"}, "work": {"$ref": "#/$defs/address"}},
+				"required": ["home"],
+				"$defs": {"address": {"type": "object", "properties": {"city": {"type": "string"}}}}
+			}`,
+			want: `{
+				"type": "OBJECT",
+				"properties": {
+					"home": {"type": "OBJECT", "properties": {"city": {"type": "STRING"}}},
+					"work": {"type": "OBJECT", "properties": {"city": {"type": "STRING"}}}
+				},
+				"required": ["home"]
+			}`,
+		},
+		{
+			name: "recursive $ref",
+			schema: `{
+				"$ref": "#/$defs/node",
+				"$defs": {"node": {"type": "object", "properties": {"next": {"$ref": "#/$defs/node"}}}}
+			}`,
+			err: "cannot convert recursive $ref #/$defs/node at /properties/next to OpenAPI",
+		},
+		{
+			name:   "dropped keywords",
+			schema: `{"type": "object", "additionalProperties": false, "properties": {"n": {"type": "number", "multipleOf": 2}}}`,
+			want:   `{"type": "OBJECT", "properties": {"n": {"type": "NUMBER"}}}`,
+			warnings: []string{
+				"/properties/n: dropped multipleOf, which responseSchema does not support",
+				"/: dropped additionalProperties, which responseSchema does not support",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatalf("invalid test schema: %v", err)
+			}
+			got, warnings, err := convertToOpenAPISchema(schema)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("invalid expected schema: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("converted = %s, want %s", gotJSON, tt.want)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
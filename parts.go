@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Types of the entries in a --parts-file
+const (
+	partTypeText = "text"
+	partTypeFile = "file"
+)
+
+// promptPart is one entry of the user turn described by --parts-file: text sent as written, or a
+// file loaded and encoded as an attachment
+type promptPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// loadPartsFile reads and validates the ordered parts of a --parts-file. Every entry must be a text
+// part with non-empty text or a file part with a path; unknown fields are rejected so that a
+// misspelled key is not silently ignored.
+func loadPartsFile(path string) ([]promptPart, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read parts file: %v", err)}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	var parts []promptPart
+	if err := decoder.Decode(&parts); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid parts file %s: %v", path, err)}
+	}
+	if len(parts) == 0 {
+		return nil, &inputError{fmt.Sprintf("parts file %s contains no parts", path)}
+	}
+
+	for i, part := range parts {
+		switch part.Type {
+		case partTypeText:
+			if strings.TrimSpace(part.Text) == "" {
+				return nil, &inputError{fmt.Sprintf("parts file %s: part %d: text part requires non-empty text", path, i+1)}
+			}
+			if part.Path != "" {
+				return nil, &inputError{fmt.Sprintf("parts file %s: part %d: text part cannot have a path", path, i+1)}
+			}
+		case partTypeFile:
+			if part.Path == "" {
+				return nil, &inputError{fmt.Sprintf("parts file %s: part %d: file part requires a path", path, i+1)}
+			}
+			if part.Path == stdinPath {
+				return nil, &inputError{fmt.Sprintf("parts file %s: part %d: file part cannot read from STDIN", path, i+1)}
+			}
+			if part.Text != "" {
+				return nil, &inputError{fmt.Sprintf("parts file %s: part %d: file part cannot have text", path, i+1)}
+			}
+		default:
+			return nil, &inputError{fmt.Sprintf("parts file %s: part %d: invalid type %q (expected text or file)", path, i+1, part.Type)}
+		}
+	}
+	return parts, nil
+}
+
+// buildPromptParts returns the parts of the user turn in --parts-file order, taking the loaded
+// attachment parts in order for the file parts
+func buildPromptParts(parts []promptPart, attachmentParts []interface{}) []interface{} {
+	contentParts := make([]interface{}, 0, len(parts))
+	next := 0
+	for _, part := range parts {
+		if part.Type == partTypeText {
+			contentParts = append(contentParts, map[string]interface{}{"text": part.Text})
+			continue
+		}
+		contentParts = append(contentParts, attachmentParts[next])
+		next++
+	}
+	return contentParts
+}
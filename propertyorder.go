@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// orderedObject is a decoded JSON object that remembers the order its members were declared in
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// decodeOrdered decodes JSON like json.Unmarshal, except that objects are decoded as
+// *orderedObject so that member order survives
+func decodeOrdered(content []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	value, err := decodeOrderedValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+func decodeOrderedValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := &orderedObject{values: map[string]interface{}{}}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyToken.(string)
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if _, duplicate := object.values[key]; !duplicate {
+				object.keys = append(object.keys, key)
+			}
+			object.values[key] = value
+		}
+		_, err := decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	default:
+		return token, nil
+	}
+}
+
+// Keywords whose value is a subschema, an array of subschemas, or an object of named subschemas
+var (
+	subschemaKeywords = []string{
+		"items", "additionalProperties", "not", "if", "then", "else", "contains",
+		"propertyNames", "unevaluatedItems", "unevaluatedProperties", "additionalItems",
+	}
+	subschemaArrayKeywords = []string{"prefixItems", "allOf", "anyOf", "oneOf"}
+	subschemaMapKeywords   = []string{"properties", "$defs", "definitions", "patternProperties", "dependentSchemas"}
+)
+
+// withPropertyOrdering parses schema content preserving member order and returns the schema with
+// a propertyOrdering array, listing the properties in declaration order, added to every
+// (sub)schema that declares properties. An existing propertyOrdering is left as written.
+func withPropertyOrdering(content []byte) (map[string]interface{}, error) {
+	decoded, err := decodeOrdered(content)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := decoded.(*orderedObject)
+	if !ok {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+	return addPropertyOrdering(root), nil
+}
+
+// addPropertyOrdering converts a decoded schema to plain maps, descending only through keywords
+// that hold subschemas so that a property named like a keyword is never mistaken for one
+func addPropertyOrdering(schema *orderedObject) map[string]interface{} {
+	result := make(map[string]interface{}, len(schema.values)+1)
+	for _, key := range schema.keys {
+		result[key] = plainJSON(schema.values[key])
+	}
+
+	for _, keyword := range subschemaKeywords {
+		if subschema, ok := schema.values[keyword].(*orderedObject); ok {
+			result[keyword] = addPropertyOrdering(subschema)
+		}
+	}
+	for _, keyword := range subschemaArrayKeywords {
+		if subschemas, ok := schema.values[keyword].([]interface{}); ok {
+			converted := make([]interface{}, len(subschemas))
+			for i, item := range subschemas {
+				if subschema, ok := item.(*orderedObject); ok {
+					converted[i] = addPropertyOrdering(subschema)
+				} else {
+					converted[i] = plainJSON(item)
+				}
+			}
+			result[keyword] = converted
+		}
+	}
+	for _, keyword := range subschemaMapKeywords {
+		if named, ok := schema.values[keyword].(*orderedObject); ok {
+			converted := make(map[string]interface{}, len(named.keys))
+			for _, name := range named.keys {
+				if subschema, ok := named.values[name].(*orderedObject); ok {
+					converted[name] = addPropertyOrdering(subschema)
+				} else {
+					converted[name] = plainJSON(named.values[name])
+				}
+			}
+			result[keyword] = converted
+		}
+	}
+
+	if properties, ok := schema.values["properties"].(*orderedObject); ok && len(properties.keys) > 0 {
+		if _, exists := schema.values["propertyOrdering"]; !exists {
+			ordering := make([]interface{}, len(properties.keys))
+			for i, name := range properties.keys {
+				ordering[i] = name
+			}
+			result["propertyOrdering"] = ordering
+		}
+	}
+	return result
+}
+
+// plainJSON converts a value from decodeOrdered into the types json.Unmarshal produces
+func plainJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *orderedObject:
+		object := make(map[string]interface{}, len(v.keys))
+		for _, key := range v.keys {
+			object[key] = plainJSON(v.values[key])
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			array[i] = plainJSON(item)
+		}
+		return array
+	default:
+		return value
+	}
+}
+
+// MarshalJSON writes the members in declaration order, so that json.Marshal and json.MarshalIndent
+// keep it
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// inDeclaredOrder returns value, as decoded by json.Unmarshal, with each object replaced by an
+// *orderedObject whose members follow the corresponding object of ordered, as decoded by
+// decodeOrdered from the same document. Members that ordered lacks, such as filled schema
+// defaults, follow in sorted order.
+func inDeclaredOrder(value, ordered interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		source, _ := ordered.(*orderedObject)
+		object := &orderedObject{values: make(map[string]interface{}, len(v))}
+		if source != nil {
+			for _, key := range source.keys {
+				if _, ok := v[key]; ok {
+					object.keys = append(object.keys, key)
+				}
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			if source == nil || !slices.Contains(source.keys, key) {
+				object.keys = append(object.keys, key)
+			}
+		}
+		for _, key := range object.keys {
+			var member interface{}
+			if source != nil {
+				member = source.values[key]
+			}
+			object.values[key] = inDeclaredOrder(v[key], member)
+		}
+		return object
+	case []interface{}:
+		source, _ := ordered.([]interface{})
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			var element interface{}
+			if i < len(source) {
+				element = source[i]
+			}
+			array[i] = inDeclaredOrder(item, element)
+		}
+		return array
+	default:
+		return value
+	}
+}
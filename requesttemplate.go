@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// JSON types of the top-level fields of a generateContent request body
+var requestFieldTypes = map[string]string{
+	"contents":          "array",
+	"systemInstruction": "object",
+	"generationConfig":  "object",
+	"tools":             "array",
+	"toolConfig":        "object",
+	"safetySettings":    "array",
+	"labels":            "object",
+	"cachedContent":     "string",
+	"modelArmorConfig":  "object",
+}
+
+// Fields that prompt2json builds from its own inputs, which a --request-template cannot set
+var (
+	managedRequestFields          = []string{"contents", "systemInstruction"}
+	managedGenerationConfigFields = []string{"responseMimeType", "responseJsonSchema", "responseSchema"}
+)
+
+// loadRequestTemplate reads a --request-template, a partial generateContent request body that
+// requests are built on. Fields that prompt2json manages are rejected rather than overwritten, so
+// that a template written for another tool does not silently lose its prompt or schema.
+func loadRequestTemplate(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to read request template: %v", err)}
+	}
+	template, err := decodeRequestTemplate(content)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid request template %s: %v", path, err)}
+	}
+	for _, field := range managedRequestFields {
+		if _, ok := template[field]; ok {
+			return nil, &inputError{fmt.Sprintf("request template %s cannot set %s, which is built from the prompt and attachments", path, field)}
+		}
+	}
+	if generationConfig, ok := template["generationConfig"].(map[string]interface{}); ok {
+		for _, field := range managedGenerationConfigFields {
+			if _, ok := generationConfig[field]; ok {
+				return nil, &inputError{fmt.Sprintf("request template %s cannot set generationConfig.%s, which is built from the schema", path, field)}
+			}
+		}
+	}
+	if err := checkRequestFields(template); err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid request template %s: %v", path, err)}
+	}
+	return content, nil
+}
+
+// decodeRequestTemplate decodes a request template, keeping numbers exactly as written
+func decodeRequestTemplate(content []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var template map[string]interface{}
+	if err := decoder.Decode(&template); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	if template == nil {
+		return nil, fmt.Errorf("must be a JSON object")
+	}
+	return template, nil
+}
+
+// applyRequestTemplate merges a request built by buildGeminiRequest into the --request-template.
+// generationConfig is merged field by field, with the fields set by options taking precedence, and
+// the googleSearch tool of --grounding is added to the template's tools.
+func applyRequestTemplate(content []byte, request map[string]interface{}) (map[string]interface{}, error) {
+	merged, err := decodeRequestTemplate(content)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("invalid request template: %v", err)}
+	}
+	for field, value := range request {
+		switch field {
+		case "generationConfig":
+			generationConfig, _ := merged[field].(map[string]interface{})
+			if generationConfig == nil {
+				generationConfig = map[string]interface{}{}
+			}
+			for key, setting := range value.(map[string]interface{}) {
+				generationConfig[key] = setting
+			}
+			merged[field] = generationConfig
+		case "tools":
+			tools, _ := merged[field].([]interface{})
+			merged[field] = append(tools, value.([]interface{})...)
+		default:
+			merged[field] = value
+		}
+	}
+	if err := checkRequestFields(merged); err != nil {
+		return nil, &inputError{fmt.Sprintf("request merged with the request template is malformed: %v", err)}
+	}
+	return merged, nil
+}
+
+// checkRequestFields checks that every top-level field of a request is a generateContent request
+// field of the right JSON type, so that a misspelled or misplaced field fails before the request is
+// sent rather than with an HTTP 400 from the API
+func checkRequestFields(request map[string]interface{}) error {
+	for _, field := range slices.Sorted(maps.Keys(request)) {
+		expected, ok := requestFieldTypes[field]
+		if !ok {
+			return fmt.Errorf("unknown request field %q", field)
+		}
+		var valid bool
+		switch request[field].(type) {
+		case []interface{}:
+			valid = expected == "array"
+		case map[string]interface{}:
+			valid = expected == "object"
+		case string:
+			valid = expected == "string"
+		}
+		if !valid {
+			return fmt.Errorf("request field %q must be a JSON %s", field, expected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Top-level shapes of a generateContent response that decodeGeminiResponse recognizes
+const (
+	responseShapeStandard = "candidates"          // The documented generateContent response
+	responseShapeWrapped  = "response.candidates" // The response nested under a "response" member
+	responseShapeChunks   = "[].candidates"       // An array of response chunks, as streamGenerateContent returns
+)
+
+type geminiCandidate struct {
+	Content struct {
+		Parts []struct {
+			Text string `json:"text"`
+		} `json:"parts"`
+	} `json:"content"`
+	FinishReason      string          `json:"finishReason"`
+	FinishMessage     string          `json:"finishMessage"`
+	GroundingMetadata json.RawMessage `json:"groundingMetadata"`
+	LogprobsResult    json.RawMessage `json:"logprobsResult"`
+}
+
+type geminiResponse struct {
+	Candidates    []geminiCandidate `json:"candidates"`
+	ModelVersion  string            `json:"modelVersion"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// decodeGeminiResponse decodes a generateContent response body and returns the shape it matched.
+// Besides the documented shape, some endpoint variants nest the response under "response" or
+// return it as an array of chunks; the chunks are merged into a single response, with the parts of
+// the first candidate concatenated in order and the other fields taken from the last chunk that
+// sets them. A body that matches no shape with candidates is returned as the documented shape, so
+// that a response without candidates is reported as such.
+func decodeGeminiResponse(body []byte) (*geminiResponse, string, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var chunks []geminiResponse
+		if err := json.Unmarshal(trimmed, &chunks); err != nil {
+			return nil, "", fmt.Errorf("failed to parse response: %v", err)
+		}
+		return mergeResponseChunks(chunks), responseShapeChunks, nil
+	}
+
+	var resp struct {
+		geminiResponse
+		Response *geminiResponse `json:"response"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", fmt.Errorf("failed to parse response: %v", err)
+	}
+	if len(resp.Candidates) == 0 && resp.Response != nil && len(resp.Response.Candidates) > 0 {
+		return resp.Response, responseShapeWrapped, nil
+	}
+	return &resp.geminiResponse, responseShapeStandard, nil
+}
+
+func mergeResponseChunks(chunks []geminiResponse) *geminiResponse {
+	merged := &geminiResponse{}
+	for _, chunk := range chunks {
+		if chunk.ModelVersion != "" {
+			merged.ModelVersion = chunk.ModelVersion
+		}
+		if chunk.UsageMetadata.TotalTokenCount > 0 {
+			merged.UsageMetadata = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		if len(merged.Candidates) == 0 {
+			merged.Candidates = []geminiCandidate{{}}
+		}
+		candidate, next := &merged.Candidates[0], chunk.Candidates[0]
+		candidate.Content.Parts = append(candidate.Content.Parts, next.Content.Parts...)
+		if next.FinishReason != "" {
+			candidate.FinishReason = next.FinishReason
+		}
+		if next.FinishMessage != "" {
+			candidate.FinishMessage = next.FinishMessage
+		}
+		if len(next.GroundingMetadata) > 0 {
+			candidate.GroundingMetadata = next.GroundingMetadata
+		}
+		if len(next.LogprobsResult) > 0 {
+			candidate.LogprobsResult = next.LogprobsResult
+		}
+	}
+	return merged
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaCache is a least-recently-used cache of compiled schemas keyed by the SHA-256 of the
+// schema content, so that identical schemas given more than once are only compiled once
+type schemaCache struct {
+	capacity int
+	order    *list.List // Most recently used entry at the front
+	entries  map[[sha256.Size]byte]*list.Element
+	hits     int
+	misses   int
+}
+
+type schemaCacheEntry struct {
+	key    [sha256.Size]byte
+	schema *jsonschema.Schema
+}
+
+func newSchemaCache(capacity int) *schemaCache {
+	return &schemaCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// get returns the compiled schema for the content, recording a hit or a miss
+func (c *schemaCache) get(content []byte) (*jsonschema.Schema, bool) {
+	element, ok := c.entries[sha256.Sum256(content)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*schemaCacheEntry).schema, true
+}
+
+// put stores the compiled schema for the content, evicting the least recently used entry when full
+func (c *schemaCache) put(content []byte, schema *jsonschema.Schema) {
+	key := sha256.Sum256(content)
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*schemaCacheEntry).schema = schema
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*schemaCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&schemaCacheEntry{key: key, schema: schema})
+}
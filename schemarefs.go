@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Keywords whose values are JSON data rather than subschemas, so a "$ref" member inside them is
+// not a reference
+var schemaDataKeywords = map[string]bool{
+	"enum": true, "const": true, "default": true, "examples": true, "example": true,
+}
+
+// Keywords whose values map names to subschemas, so a member named "$ref" is a name rather than a
+// reference
+var schemaMapKeywords = map[string]bool{
+	"properties": true, "patternProperties": true, "$defs": true, "definitions": true, "dependentSchemas": true,
+}
+
+// checkSchemaRefs walks a schema for --strict-schema and reports every $ref that does not resolve,
+// with the JSON Pointer of the $ref itself. Local references ("#", "#/pointer", or "#anchor") must
+// resolve within the document. References to other documents are resolved when the schema is
+// compiled, except with localOnly for a schema that is sent to the API without being compiled,
+// where they cannot be resolved at all.
+func checkSchemaRefs(src string, content []byte, localOnly bool) error {
+	var root interface{}
+	if err := json.Unmarshal(content, &root); err != nil {
+		return &inputError{fmt.Sprintf("invalid JSON in schema %s: %v", src, err)}
+	}
+
+	anchors := map[string]bool{}
+	walkSchema(root, "", func(schema map[string]interface{}, _ string) {
+		if anchor, ok := schema["$anchor"].(string); ok {
+			anchors[anchor] = true
+		}
+	})
+
+	var unresolved []string
+	walkSchema(root, "", func(schema map[string]interface{}, path string) {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return
+		}
+		location := path + "/$ref"
+		base, fragment, _ := strings.Cut(ref, "#")
+		switch {
+		case base != "":
+			if localOnly {
+				unresolved = append(unresolved, fmt.Sprintf("%s: %s refers to another document, which the API cannot resolve", location, ref))
+			}
+		case fragment == "" || strings.HasPrefix(fragment, "/"):
+			pointer, err := url.PathUnescape(fragment)
+			if err == nil {
+				var tokens []string
+				if tokens, err = parseJSONPointer(pointer); err == nil {
+					var target interface{}
+					if target, err = resolveJSONPointer(root, tokens); err == nil {
+						if _, isSchema := target.(map[string]interface{}); !isSchema {
+							if _, isBool := target.(bool); !isBool {
+								err = fmt.Errorf("target is not a schema")
+							}
+						}
+					}
+				}
+			}
+			if err != nil {
+				unresolved = append(unresolved, fmt.Sprintf("%s: %s does not resolve (%v)", location, ref, err))
+			}
+		case !anchors[fragment]:
+			unresolved = append(unresolved, fmt.Sprintf("%s: %s does not match any $anchor", location, ref))
+		}
+	})
+
+	if len(unresolved) > 0 {
+		return &inputError{fmt.Sprintf("unresolved $ref in schema %s: %s", src, strings.Join(unresolved, "; "))}
+	}
+	return nil
+}
+
+// walkSchema calls visit for the schema and every subschema below it, in a stable order, passing
+// the JSON Pointer of each
+func walkSchema(value interface{}, path string, visit func(schema map[string]interface{}, path string)) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		visit(v, path)
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			if schemaDataKeywords[key] {
+				continue
+			}
+			keyPath := path + "/" + escapeJSONPointerToken(key)
+			if members, ok := v[key].(map[string]interface{}); ok && schemaMapKeywords[key] {
+				for _, name := range slices.Sorted(maps.Keys(members)) {
+					walkSchema(members[name], keyPath+"/"+escapeJSONPointerToken(name), visit)
+				}
+				continue
+			}
+			walkSchema(v[key], keyPath, visit)
+		}
+	case []interface{}:
+		for i, item := range v {
+			walkSchema(item, fmt.Sprintf("%s/%d", path, i), visit)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sortedJSON serializes a decoded JSON value in the fixed form used by --sorted, which does not
+// depend on encoding/json's formatting choices: object keys sorted by their UTF-8 bytes, array
+// order preserved, json.Number values written exactly as decoded, other numbers formatted as
+// --normalize does, and strings using the minimal JSON escaping. With indent, every member and
+// item is placed on its own line indented by two spaces per level, with ": " after each key and
+// empty objects and arrays written as {} and [].
+func sortedJSON(value interface{}, indent bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeSorted(&buf, value, indent, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeSorted(buf *bytes.Buffer, value interface{}, indent bool, depth int) error {
+	switch v := value.(type) {
+	case json.Number:
+		if !json.Valid([]byte(v)) {
+			return fmt.Errorf("invalid JSON number %q", string(v))
+		}
+		buf.WriteString(string(v))
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeSortedNewline(buf, indent, depth+1)
+			if err := writeSorted(buf, item, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		writeSortedNewline(buf, indent, depth)
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeSortedNewline(buf, indent, depth+1)
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if indent {
+				buf.WriteByte(' ')
+			}
+			if err := writeSorted(buf, v[key], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		writeSortedNewline(buf, indent, depth)
+		buf.WriteByte('}')
+	default:
+		// Scalars are serialized as --normalize does
+		return writeCanonical(buf, value)
+	}
+	return nil
+}
+
+func writeSortedNewline(buf *bytes.Buffer, indent bool, depth int) {
+	if indent {
+		buf.WriteByte('\n')
+		buf.WriteString(strings.Repeat("  ", depth))
+	}
+}
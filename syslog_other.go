@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "io"
+
+// openSyslog reports that the system log is unavailable, since log/syslog only supports Unix
+func openSyslog(priority, tag string) (io.Writer, error) {
+	return nil, &cliError{"--syslog is not supported on this platform"}
+}
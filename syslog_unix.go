@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+var syslogSeverities = map[string]syslog.Priority{
+	"emerg": syslog.LOG_EMERG, "alert": syslog.LOG_ALERT, "crit": syslog.LOG_CRIT,
+	"err": syslog.LOG_ERR, "warning": syslog.LOG_WARNING, "notice": syslog.LOG_NOTICE,
+	"info": syslog.LOG_INFO, "debug": syslog.LOG_DEBUG,
+}
+
+// openSyslog connects to the local system log (syslog, or journald through its syslog socket).
+// The priority is a severity such as "info", optionally preceded by a facility as in "local0.info";
+// the facility defaults to user.
+func openSyslog(priority, tag string) (io.Writer, error) {
+	facility, severity := "user", strings.ToLower(priority)
+	if before, after, ok := strings.Cut(severity, "."); ok {
+		facility, severity = before, after
+	}
+	facilityValue, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, &cliError{fmt.Sprintf("invalid --syslog-priority %q: unknown facility %q", priority, facility)}
+	}
+	severityValue, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, &cliError{fmt.Sprintf("invalid --syslog-priority %q: unknown severity %q (expected emerg, alert, crit, err, warning, notice, info, or debug)", priority, severity)}
+	}
+
+	writer, err := syslog.New(facilityValue|severityValue, tag)
+	if err != nil {
+		return nil, &inputError{fmt.Sprintf("failed to connect to the system log: %v", err)}
+	}
+	return writer, nil
+}
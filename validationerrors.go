@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// validationIssue is one distinct failing leaf of a schema validation error
+type validationIssue struct {
+	Location string // JSON Pointer into the response
+	Keyword  string
+	Message  string
+	branches int // anyOf and oneOf alternatives the failure is nested in
+}
+
+func (issue validationIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", issue.Location, issue.Keyword, issue.Message)
+}
+
+// rankValidationIssues flattens a validation error into its distinct leaf failures, most relevant
+// first. A single wrong value inside a oneOf is reported once per alternative, so identical failures
+// are folded together. Failures outside any anyOf or oneOf alternative come first, since they hold
+// whichever alternative is chosen; type mismatches inside an alternative come last, since they
+// mostly show that the alternative was not the intended one. Ties go to the more specific location,
+// deepest in the response, and then to the order the validator reported them in.
+func rankValidationIssues(err *jsonschema.ValidationError, pointer string) []validationIssue {
+	var issues []validationIssue
+	seen := map[validationIssue]bool{}
+	var collect func(*jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) > 0 {
+			for _, cause := range e.Causes {
+				collect(cause)
+			}
+			return
+		}
+		issue := validationIssue{
+			Location: pointer + e.InstanceLocation,
+			Keyword:  e.KeywordLocation[strings.LastIndex(e.KeywordLocation, "/")+1:],
+			Message:  e.Message,
+		}
+		if issue.Location == "" {
+			issue.Location = "/"
+		}
+		for _, token := range strings.Split(e.KeywordLocation, "/") {
+			if token == "anyOf" || token == "oneOf" {
+				issue.branches++
+			}
+		}
+		key := issue
+		key.branches = 0
+		if !seen[key] {
+			seen[key] = true
+			issues = append(issues, issue)
+		}
+	}
+	collect(err)
+
+	slices.SortStableFunc(issues, func(a, b validationIssue) int {
+		if a.branches != b.branches {
+			return a.branches - b.branches
+		}
+		if aType, bType := a.branches > 0 && a.Keyword == "type", b.branches > 0 && b.Keyword == "type"; aType != bType {
+			if aType {
+				return 1
+			}
+			return -1
+		}
+		return strings.Count(b.Location, "/") - strings.Count(a.Location, "/")
+	})
+	return issues
+}
+
+// describeValidationFailure formats the ranked failures of a validation error, up to maxErrors of
+// them: a single failure on one line, or several as an indented list noting how many were left out
+func describeValidationFailure(err error, pointer string, maxErrors int) string {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err.Error()
+	}
+	issues := rankValidationIssues(validationErr, pointer)
+	if len(issues) == 1 {
+		return issues[0].String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d errors", len(issues))
+	for _, issue := range issues[:min(len(issues), maxErrors)] {
+		fmt.Fprintf(&b, "\n  %s", issue)
+	}
+	if omitted := len(issues) - maxErrors; omitted > 0 {
+		fmt.Fprintf(&b, "\n  (and %d more; raise --max-errors to show them)", omitted)
+	}
+	return b.String()
+}
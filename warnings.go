@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Kinds of advisory warnings, named in the --fail-on-warnings summary
+const (
+	warningDeprecatedModel  = "deprecated model"
+	warningLargeSchema      = "large schema"
+	warningSchemaConversion = "schema conversion"
+)
+
+// advisoryWarnings records the kind of each advisory warning of a run, for --fail-on-warnings and
+// the lint-schema summary
+type advisoryWarnings struct {
+	mu    sync.Mutex
+	kinds []string
+}
+
+// warnAdvisory logs an advisory warning, one that points out a problem without affecting the
+// result. --quiet suppresses the message, but the warning is still recorded.
+func warnAdvisory(config *Config, kind, format string, args ...interface{}) {
+	config.Warnings.mu.Lock()
+	config.Warnings.kinds = append(config.Warnings.kinds, kind)
+	config.Warnings.mu.Unlock()
+	if !quiet {
+		config.Log.Printf("Warning: "+format, args...)
+	}
+}
+
+// checkAdvisoryWarnings returns a warningError summarizing the advisory warnings recorded so far
+// when --fail-on-warnings is set, by kind in the order they first fired
+func checkAdvisoryWarnings(config *Config) error {
+	if !config.FailOnWarnings {
+		return nil
+	}
+	config.Warnings.mu.Lock()
+	defer config.Warnings.mu.Unlock()
+	if len(config.Warnings.kinds) == 0 {
+		return nil
+	}
+
+	var order []string
+	counts := map[string]int{}
+	for _, kind := range config.Warnings.kinds {
+		if counts[kind] == 0 {
+			order = append(order, kind)
+		}
+		counts[kind]++
+	}
+	summary := make([]string, len(order))
+	for i, kind := range order {
+		summary[i] = fmt.Sprintf("%s (%d)", kind, counts[kind])
+	}
+	noun := "warnings"
+	if len(config.Warnings.kinds) == 1 {
+		noun = "warning"
+	}
+	return &warningError{fmt.Sprintf("%d advisory %s with --fail-on-warnings: %s", len(config.Warnings.kinds), noun, strings.Join(summary, ", "))}
+}